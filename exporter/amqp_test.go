@@ -0,0 +1,45 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/mtail/metrics"
+)
+
+func TestWriteAMQPMetricsUnreachable(t *testing.T) {
+	// Find a port with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.amqp = newAMQPPublisher("amqp://guest:guest@"+addr+"/", "", "mtail")
+
+	total, success := amqpExportTotal.Value(), amqpExportSuccess.Value()
+	if err := e.writeAMQPMetrics(); err == nil {
+		t.Errorf("expected error publishing to %s", addr)
+	}
+	if r := amqpExportTotal.Value() - total; r != 1 {
+		t.Errorf("expected 1 metric exported, received %d", r)
+	}
+	if r := amqpExportSuccess.Value() - success; r != 0 {
+		t.Errorf("expected no successful exports, received %d", r)
+	}
+	if e.amqp.conn != nil {
+		t.Errorf("expected no connection after failure")
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	azureTargetName = "azure_monitor"
+
+	// Azure Monitor accepts at most this many dimensions on a custom metric.
+	azureMaxDimensions = 10
+
+	azureMetadataURL  = "http://169.254.169.254"
+	azureMonitorScope = "https://monitoring.azure.com/"
+)
+
+var (
+	azureMonitor = flag.Bool("azure_monitor", false,
+		"Push metrics to Azure Monitor custom metrics, authenticating with the managed identity of the instance.")
+	azureRegion = flag.String("azure_monitor_region", "",
+		"Azure region of the resource the metrics are recorded against.  If empty, the region is read from the instance metadata service.")
+	azureResourceID = flag.String("azure_monitor_resource_id", "",
+		"Azure resource ID that the metrics are recorded against.  If empty, the resource ID of the instance is read from the instance metadata service.")
+	azureNamespace = flag.String("azure_monitor_namespace", "mtail",
+		"Namespace of the custom metrics pushed to Azure Monitor.")
+
+	azureExportTotal   = expvar.NewInt("azure_monitor_export_total")
+	azureExportSuccess = expvar.NewInt("azure_monitor_export_success")
+)
+
+// azureClient pushes metrics to the Azure Monitor custom metrics ingestion
+// API.
+type azureClient struct {
+	client      *http.Client
+	metadataURL string // Base URL of the instance metadata service.
+	endpoint    string // Base URL of the ingestion API; if empty, the regional endpoint is used.
+
+	region, resourceID string
+
+	mu      sync.Mutex
+	token   string    // Access token for the monitoring API.
+	expires time.Time // Expiry time of the token.
+
+	last map[string]float64 // Value of each counter series at the previous push.
+}
+
+func newAzureClient(region, resourceID string) *azureClient {
+	return &azureClient{
+		client:      &http.Client{Timeout: *writeDeadline},
+		metadataURL: azureMetadataURL,
+		region:      region,
+		resourceID:  resourceID,
+		last:        make(map[string]float64),
+	}
+}
+
+// azureSeries is the value of one set of dimension values of a custom
+// metric, aggregated over the push interval.
+type azureSeries struct {
+	DimValues []string `json:"dimValues,omitempty"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     int      `json:"count"`
+}
+
+type azureBaseData struct {
+	Metric    string        `json:"metric"`
+	Namespace string        `json:"namespace"`
+	DimNames  []string      `json:"dimNames,omitempty"`
+	Series    []azureSeries `json:"series"`
+}
+
+// azureMetric is the body of a request to the custom metrics API.
+type azureMetric struct {
+	Time string `json:"time"`
+	Data struct {
+		BaseData azureBaseData `json:"baseData"`
+	} `json:"data"`
+}
+
+// metadata fetches a JSON document from the instance metadata service.
+func (a *azureClient) metadata(path string, query url.Values, v interface{}) error {
+	req, err := http.NewRequest("GET", a.metadataURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("instance metadata %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// resolve fills in the region and resource ID from the instance metadata if
+// they weren't configured.
+func (a *azureClient) resolve() error {
+	if a.region != "" && a.resourceID != "" {
+		return nil
+	}
+	var compute struct {
+		Location   string `json:"location"`
+		ResourceID string `json:"resourceId"`
+	}
+	q := url.Values{"api-version": {"2019-08-15"}, "format": {"json"}}
+	if err := a.metadata("/metadata/instance/compute", q, &compute); err != nil {
+		return errors.Wrap(err, "reading instance location")
+	}
+	if a.region == "" {
+		a.region = compute.Location
+	}
+	if a.resourceID == "" {
+		a.resourceID = compute.ResourceID
+	}
+	glog.Infof("Pushing to Azure Monitor in region %s for resource %s", a.region, a.resourceID)
+	return nil
+}
+
+// accessToken returns a token for the monitoring API, fetching a new token
+// from the managed identity endpoint when the cached token is near expiry.
+func (a *azureClient) accessToken(now time.Time) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && now.Add(time.Minute).Before(a.expires) {
+		return a.token, nil
+	}
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {azureMonitorScope}}
+	if err := a.metadata("/metadata/identity/oauth2/token", q, &t); err != nil {
+		return "", errors.Wrap(err, "fetching managed identity token")
+	}
+	expires, err := strconv.ParseInt(t.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "parsing token expiry %q", t.ExpiresOn)
+	}
+	a.token = t.AccessToken
+	a.expires = time.Unix(expires, 0)
+	return a.token, nil
+}
+
+// azureDimensions returns the names of the dimensions of the custom metric
+// for a metric: its keys and the constant labels, in order, and then the
+// program.
+func (e *Exporter) azureDimensions(m *metrics.Metric) []string {
+	keys := append([]string{}, m.Keys...)
+	for k := range e.constLabels {
+		if !hasKey(m.Keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if !e.o.OmitProgLabel {
+		keys = append(keys, "prog")
+	}
+	return keys
+}
+
+// metricToAzure converts a metric to a custom metric request body with the
+// given dimensions.  Counters are sent as their increase since the previous
+// push, as Azure Monitor aggregates the values it receives; the first push of
+// a counter series only records its starting value.  Gauges and timers are
+// sent as their current value.  The values of the counter series are
+// returned too, to be recorded as the previous values once the body has been
+// sent.  The metric lock is held before entering this function.
+func (e *Exporter) metricToAzure(m *metrics.Metric, keys []string, now time.Time) (*azureMetric, map[string]float64) {
+	pending := make(map[string]float64)
+	am := &azureMetric{Time: now.UTC().Format(time.RFC3339)}
+	am.Data.BaseData = azureBaseData{
+		Metric:    m.Name,
+		Namespace: *azureNamespace,
+		DimNames:  keys,
+		Series:    []azureSeries{},
+	}
+	lc := make(chan *metrics.LabelSet)
+	go e.emitLabelSets(m, lc)
+	for l := range lc {
+		var values []string
+		for _, k := range keys {
+			if k == "prog" && !e.o.OmitProgLabel {
+				values = append(values, m.Program)
+				continue
+			}
+			values = append(values, l.Labels[k])
+		}
+		v := pushValue(l.Datum)
+		if m.Kind == metrics.Counter {
+			series := m.Program + "\x00" + m.Name + "\x00" + strings.Join(values, "\x00")
+			prev, ok := e.azure.last[series]
+			pending[series] = v
+			if !ok {
+				continue
+			}
+			if v >= prev {
+				v -= prev
+			}
+		}
+		am.Data.BaseData.Series = append(am.Data.BaseData.Series, azureSeries{
+			DimValues: values,
+			Min:       v,
+			Max:       v,
+			Sum:       v,
+			Count:     1,
+		})
+	}
+	return am, pending
+}
+
+// post sends one custom metric to the ingestion API.
+func (a *azureClient) post(token string, am *azureMetric) error {
+	b, err := json.Marshal(am)
+	if err != nil {
+		return err
+	}
+	endpoint := a.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.monitoring.azure.com", a.region)
+	}
+	req, err := http.NewRequest("POST", endpoint+a.resourceID+"/metrics", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := doHTTPPush(azureTargetName, a.client, req, b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// azurePost is a custom metric to send, and the values of its counter series
+// to record once it has been sent.
+type azurePost struct {
+	name    string
+	am      *azureMetric
+	pending map[string]float64
+}
+
+// writeAzureMetrics sends each metric in the store to Azure Monitor.  Metrics
+// with more dimensions than Azure Monitor allows can never be sent, so they
+// are counted as dropped and left out.  Metrics that Azure Monitor rejects
+// are logged and skipped, and the push fails if any metric was not sent.  The
+// request bodies are built with the store locked, and sent once it is
+// unlocked, so a slow endpoint doesn't hold up the store.  The previous values
+// of counters are only updated when their metric is sent, so the increase of a
+// counter over a failed push is sent on the next push.
+func (e *Exporter) writeAzureMetrics() error {
+	a := e.azure
+	if err := a.resolve(); err != nil {
+		return err
+	}
+	now := time.Now()
+	token, err := a.accessToken(now)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	var posts []azurePost
+	e.store.RLock()
+	for _, ml := range e.store.Metrics {
+		for _, m := range ml {
+			if !e.pushes(m, azureTargetName) {
+				continue
+			}
+			m.RLock()
+			keys := e.azureDimensions(m)
+			if len(keys) > azureMaxDimensions {
+				glog.V(1).Infof("Not pushing %s to azure monitor: %d dimensions, more than the %d allowed", m.Name, len(keys), azureMaxDimensions)
+				e.dropped.add(dropTooManyDimensions, azureTargetName, int64(len(m.LabelValues)))
+				m.RUnlock()
+				continue
+			}
+			azureExportTotal.Add(1)
+			am, pending := e.metricToAzure(m, keys, now)
+			m.RUnlock()
+			posts = append(posts, azurePost{m.Name, am, pending})
+		}
+	}
+	e.store.RUnlock()
+
+	for _, p := range posts {
+		if len(p.am.Data.BaseData.Series) > 0 {
+			if err := a.post(token, p.am); err != nil {
+				glog.Infof("azure monitor push of %s failed: %s", p.name, err)
+				failed++
+				continue
+			}
+		}
+		for series, v := range p.pending {
+			a.last[series] = v
+		}
+		azureExportSuccess.Add(1)
+	}
+	if failed > 0 {
+		return errors.Errorf("%d metrics not pushed to azure monitor", failed)
+	}
+	return nil
+}
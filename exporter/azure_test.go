@@ -0,0 +1,255 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+// fakeAzure serves the instance metadata service and the custom metrics
+// ingestion API.
+type fakeAzure struct {
+	mu       sync.Mutex
+	tokens   int                    // Number of tokens issued.
+	fail     bool                   // If true, metrics are refused.
+	received map[string]azureMetric // Received metrics by name.
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/metadata/instance/compute":
+		fmt.Fprint(w, `{"location": "westus2", "resourceId": "/subscriptions/s/resourceGroups/g/providers/Microsoft.Compute/virtualMachines/vm"}`)
+	case "/metadata/identity/oauth2/token":
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing Metadata header", http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token": "token%d", "expires_on": "%d"}`, f.tokens, time.Now().Add(time.Hour).Unix())
+	case "/subscriptions/s/resourceGroups/g/providers/Microsoft.Compute/virtualMachines/vm/metrics":
+		if f.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token1" {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		var am azureMetric
+		if err := json.NewDecoder(r.Body).Decode(&am); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.received[am.Data.BaseData.Metric] = am
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWriteAzureMetrics(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	d, _ := c.GetDatum("200")
+	datum.SetInt(d, 10, ts)
+	ms.Add(c)
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float)
+	gd, _ := g.GetDatum()
+	datum.SetFloat(gd, -1.5, ts)
+	ms.Add(g)
+
+	f := &fakeAzure{received: make(map[string]azureMetric)}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.azure = newAzureClient("", "")
+	e.azure.metadataURL = s.URL
+	e.azure.endpoint = s.URL
+
+	// The first push only records the starting value of the counter.
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	if e.azure.region != "westus2" {
+		t.Errorf("region not read from metadata: %q", e.azure.region)
+	}
+	if _, ok := f.received["requests"]; ok {
+		t.Errorf("counter sent on first push")
+	}
+	expected := azureBaseData{
+		Metric:    "temperature",
+		Namespace: "mtail",
+		DimNames:  []string{"prog"},
+		Series:    []azureSeries{{DimValues: []string{"prog"}, Min: -1.5, Max: -1.5, Sum: -1.5, Count: 1}},
+	}
+	if diff := cmp.Diff(expected, f.received["temperature"].Data.BaseData); diff != "" {
+		t.Errorf("gauge didn't match:\n%s", diff)
+	}
+
+	datum.IncIntBy(d, 5, ts)
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	expected = azureBaseData{
+		Metric:    "requests",
+		Namespace: "mtail",
+		DimNames:  []string{"code", "prog"},
+		Series:    []azureSeries{{DimValues: []string{"200", "prog"}, Min: 5, Max: 5, Sum: 5, Count: 1}},
+	}
+	if diff := cmp.Diff(expected, f.received["requests"].Data.BaseData); diff != "" {
+		t.Errorf("counter didn't match:\n%s", diff)
+	}
+	if f.tokens != 1 {
+		t.Errorf("expected token to be cached, fetched %d", f.tokens)
+	}
+}
+
+func TestWriteAzureMetricsFailedPush(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int)
+	d, _ := c.GetDatum()
+	datum.SetInt(d, 10, ts)
+	ms.Add(c)
+
+	f := &fakeAzure{received: make(map[string]azureMetric)}
+	s := httptest.NewServer(f)
+	defer s.Close()
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.azure = newAzureClient("", "")
+	e.azure.metadataURL = s.URL
+	e.azure.endpoint = s.URL
+
+	// Record the starting value, then fail a push.
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	datum.IncIntBy(d, 5, ts)
+	f.mu.Lock()
+	f.fail = true
+	f.mu.Unlock()
+	if err := e.writeAzureMetrics(); err == nil {
+		t.Fatalf("expected push to fail")
+	}
+	// The next push sends the increase over both intervals.
+	datum.IncIntBy(d, 2, ts)
+	f.mu.Lock()
+	f.fail = false
+	f.mu.Unlock()
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	series := f.received["requests"].Data.BaseData.Series
+	if len(series) != 1 || series[0].Sum != 7 {
+		t.Errorf("expected an increase of 7, received %v", series)
+	}
+}
+
+func TestWriteAzureMetricsTooManyDimensions(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	wide := metrics.NewMetric("wide", "prog", metrics.Gauge, metrics.Int, keys...)
+	d, _ := wide.GetDatum(keys...)
+	datum.SetInt(d, 1, ts)
+	ms.Add(wide)
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Int)
+	d, _ = g.GetDatum()
+	datum.SetInt(d, 20, ts)
+	ms.Add(g)
+
+	f := &fakeAzure{received: make(map[string]azureMetric)}
+	s := httptest.NewServer(f)
+	defer s.Close()
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.azure = newAzureClient("", "")
+	e.azure.metadataURL = s.URL
+	e.azure.endpoint = s.URL
+
+	// The metric with 11 dimensions, counting prog, is left out, and the push
+	// still succeeds.
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	if _, ok := f.received["wide"]; ok {
+		t.Errorf("metric with too many dimensions was sent")
+	}
+	if _, ok := f.received["temperature"]; !ok {
+		t.Errorf("metric with few dimensions wasn't sent")
+	}
+	e.dropped.flush()
+	dd, err := e.dropped.m.GetDatum(dropTooManyDimensions, azureTargetName)
+	if err != nil {
+		t.Fatalf("couldn't get dropped datum: %s", err)
+	}
+	if r := datum.GetInt(dd); r != 1 {
+		t.Errorf("expected 1 dropped series, received %d", r)
+	}
+
+	// Without the prog dimension, the metric fits.
+	e.o.OmitProgLabel = true
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	if _, ok := f.received["wide"]; !ok {
+		t.Errorf("metric with 10 dimensions wasn't sent")
+	}
+}
+
+func TestWriteAzureMetricsConstLabels(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	g := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Int, "zone")
+	d, _ := g.GetDatum("a")
+	datum.SetInt(d, 20, ts)
+	ms.Add(g)
+
+	f := &fakeAzure{received: make(map[string]azureMetric)}
+	s := httptest.NewServer(f)
+	defer s.Close()
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.constLabels = map[string]string{"region": "us-east1", "zone": "b"}
+	e.azure = newAzureClient("", "")
+	e.azure.metadataURL = s.URL
+	e.azure.endpoint = s.URL
+
+	if err := e.writeAzureMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	// The series' own zone label takes precedence over the constant label.
+	expected := azureBaseData{
+		Metric:    "temperature",
+		Namespace: "mtail",
+		DimNames:  []string{"region", "zone", "prog"},
+		Series:    []azureSeries{{DimValues: []string{"us-east1", "a", "prog"}, Min: 20, Max: 20, Sum: 20, Count: 1}},
+	}
+	if diff := cmp.Diff(expected, f.received["temperature"].Data.BaseData); diff != "" {
+		t.Errorf("metric didn't match:\n%s", diff)
+	}
+}
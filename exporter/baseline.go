@@ -0,0 +1,100 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+var baselineMetrics = flag.String("metric_push_baseline", "",
+	"Comma separated list of metric names whose values are pushed to collectd, graphite and statsd as the increase since a baseline.  The baseline of each series is its value at the first push after mtail starts, or after a POST to /baseline.")
+
+// baselines holds the value of each series of the baselined metrics at the
+// push its baseline was captured.
+type baselines struct {
+	names map[string]struct{} // Names of the metrics with a baseline.
+
+	mu     sync.Mutex
+	values map[string]float64 // Baseline of each series, by program, name and labels.
+}
+
+func newBaselines(names string) *baselines {
+	if names == "" {
+		return nil
+	}
+	b := &baselines{names: make(map[string]struct{}), values: make(map[string]float64)}
+	for _, n := range strings.Split(names, ",") {
+		b.names[strings.TrimSpace(n)] = struct{}{}
+	}
+	return b
+}
+
+// applies reports whether the metric has a baseline.  It is safe to call on a
+// nil baselines.
+func (b *baselines) applies(m *metrics.Metric) bool {
+	if b == nil {
+		return false
+	}
+	_, ok := b.names[m.Name]
+	return ok
+}
+
+// subtract returns a LabelSet with the value of l less the baseline of the
+// series, capturing the current value as the baseline if the series doesn't
+// have one yet.
+func (b *baselines) subtract(m *metrics.Metric, l *metrics.LabelSet) *metrics.LabelSet {
+	values := make([]string, 0, len(m.Keys))
+	for _, k := range m.Keys {
+		values = append(values, l.Labels[k])
+	}
+	series := m.Program + "\x00" + m.Name + "\x00" + strings.Join(values, "\x00")
+	v := datumValue(l.Datum)
+	b.mu.Lock()
+	base, ok := b.values[series]
+	if !ok {
+		base = v
+		b.values[series] = v
+	}
+	b.mu.Unlock()
+	var d datum.Datum
+	if l.Datum.Type() == datum.Float {
+		d = datum.MakeFloat(v-base, l.Datum.TimeUTC())
+	} else {
+		d = datum.MakeInt(datum.GetInt(l.Datum)-int64(base), l.Datum.TimeUTC())
+	}
+	return &metrics.LabelSet{Labels: l.Labels, Datum: d}
+}
+
+// reset discards the baselines, so they are captured again on the next push.
+func (b *baselines) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values = make(map[string]float64)
+}
+
+// HandleBaseline resets the baselines of the metrics listed in
+// metric_push_baseline on a POST, so that the next push captures them again.
+func (e *Exporter) HandleBaseline(w http.ResponseWriter, r *http.Request) {
+	if e.baselines == nil {
+		http.Error(w, "no metrics have a baseline", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e.baselines.reset()
+	glog.Info("Push baselines reset")
+	w.Header().Set("Content-type", "text/plain")
+	fmt.Fprintln(w, "baselines reset")
+}
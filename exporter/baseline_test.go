@@ -0,0 +1,68 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestWriteSocketMetricsBaseline(t *testing.T) {
+	*graphitePrefix = ""
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int)
+	d, _ := c.GetDatum()
+	datum.SetInt(d, 1000, ts)
+	ms.Add(c)
+	o := metrics.NewMetric("other", "prog", metrics.Counter, metrics.Int)
+	od, _ := o.GetDatum()
+	datum.SetInt(od, 5, ts)
+	ms.Add(o)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.baselines = newBaselines("requests")
+	target := pushOptions{
+		name:    "baseline",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	push := func() string {
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+		return b.String()
+	}
+
+	if diff := cmp.Diff("prog.other 5 1343124840\nprog.requests 0 1343124840\n", push()); diff != "" {
+		t.Errorf("first push didn't match:\n%s", diff)
+	}
+	datum.IncIntBy(d, 7, ts)
+	if diff := cmp.Diff("prog.other 5 1343124840\nprog.requests 7 1343124840\n", push()); diff != "" {
+		t.Errorf("second push didn't match:\n%s", diff)
+	}
+
+	w := httptest.NewRecorder()
+	e.HandleBaseline(w, httptest.NewRequest("POST", "/baseline", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("reset failed: %d", w.Code)
+	}
+	datum.IncIntBy(d, 3, ts)
+	if diff := cmp.Diff("prog.other 5 1343124840\nprog.requests 0 1343124840\n", push()); diff != "" {
+		t.Errorf("push after reset didn't match:\n%s", diff)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"sort"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+const labelCardinalityName = "mtail_metric_label_cardinality"
+
+var (
+	emitLabelCardinality = flag.Bool("emit_label_cardinality", false,
+		"Export the gauge "+labelCardinalityName+", the number of distinct values of each label of each metric, computed at each export.")
+)
+
+// newLabelCardinality creates the label cardinality metric and adds it to
+// the store.
+func newLabelCardinality(ms *metrics.Store) (*metrics.Metric, error) {
+	m := metrics.NewMetric(labelCardinalityName, "mtail", metrics.Gauge, metrics.Int, "metric", "label")
+	m.Public = true
+	if err := ms.Add(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// updateLabelCardinality counts the distinct values of each label key of each
+// metric in the store, and replaces the values of the label cardinality
+// metric with the counts, so metrics and labels that have gone from the store
+// are no longer reported.  Metrics with the same name in different programs
+// are counted together.
+func (e *Exporter) updateLabelCardinality() {
+	if e.cardinality == nil {
+		return
+	}
+	counts := make(map[[2]string]int)
+	e.store.RLock()
+	for name, ml := range e.store.Metrics {
+		if name == labelCardinalityName {
+			continue
+		}
+		values := make(map[[2]string]map[string]struct{})
+		for _, m := range ml {
+			m.RLock()
+			for i, k := range m.Keys {
+				key := [2]string{name, k}
+				if values[key] == nil {
+					values[key] = make(map[string]struct{})
+				}
+				for _, lv := range m.LabelValues {
+					values[key][lv.Labels[i]] = struct{}{}
+				}
+			}
+			m.RUnlock()
+		}
+		for key, v := range values {
+			counts[key] = len(v)
+		}
+	}
+	e.store.RUnlock()
+
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Sort(byLabelKey(keys))
+	now := time.Now()
+	lvs := make([]*metrics.LabelValue, 0, len(keys))
+	for _, key := range keys {
+		d := datum.NewInt()
+		datum.SetInt(d, int64(counts[key]), now)
+		lvs = append(lvs, &metrics.LabelValue{Labels: []string{key[0], key[1]}, Value: d})
+	}
+	e.cardinality.Lock()
+	e.cardinality.LabelValues = lvs
+	e.cardinality.Unlock()
+}
+
+// byLabelKey sorts pairs of metric and label names, by metric and then by
+// label.
+type byLabelKey [][2]string
+
+func (b byLabelKey) Len() int      { return len(b) }
+func (b byLabelKey) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLabelKey) Less(i, j int) bool {
+	if b[i][0] != b[j][0] {
+		return b[i][0] < b[j][0]
+	}
+	return b[i][1] < b[j][1]
+}
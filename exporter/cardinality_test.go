@@ -0,0 +1,54 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+)
+
+func TestUpdateLabelCardinality(t *testing.T) {
+	defer func(b bool) { *emitLabelCardinality = b }(*emitLabelCardinality)
+	*emitLabelCardinality = true
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code", "method")
+	m.GetDatum("200", "GET")
+	m.GetDatum("200", "POST")
+	m.GetDatum("404", "GET")
+	ms.Add(m)
+	m2 := metrics.NewMetric("requests", "other", metrics.Counter, metrics.Int, "code", "method")
+	m2.GetDatum("500", "GET")
+	ms.Add(m2)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.updateLabelCardinality()
+
+	counts := func() map[string]string {
+		r := make(map[string]string)
+		lc := make(chan *metrics.LabelSet)
+		go e.cardinality.EmitLabelSets(lc)
+		for l := range lc {
+			r[l.Labels["metric"]+"."+l.Labels["label"]] = l.Datum.ValueString()
+		}
+		return r
+	}
+	expected := map[string]string{"requests.code": "3", "requests.method": "2"}
+	if diff := cmp.Diff(expected, counts()); diff != "" {
+		t.Errorf("cardinality didn't match:\n%s", diff)
+	}
+
+	// Metrics removed from the store are no longer reported.
+	ms.ClearMetrics()
+	ms.Add(e.cardinality)
+	e.updateLabelCardinality()
+	if diff := cmp.Diff(map[string]string{}, counts()); diff != "" {
+		t.Errorf("cardinality didn't match:\n%s", diff)
+	}
+}
@@ -4,12 +4,15 @@
 package exporter
 
 import (
+	"bufio"
 	"expvar"
 	"flag"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -21,6 +24,12 @@ var (
 		"Path to collectd unixsock to write metrics to.")
 	collectdPrefix = flag.String("collectd_prefix", "",
 		"Prefix to use for collectd metrics.")
+	collectdRequireLabel = flag.String("collectd_require_label", "",
+		"If set to a label and value, e.g. safe:true, only series with exactly that label and value are pushed to collectd.  Other series are skipped, and counted in metric_push_label_filtered_total.")
+	collectdDialTimeout = flag.Duration("collectd_dial_timeout", 0,
+		"Time to wait to connect to collectd on each push.  If 0, metric_push_write_deadline is used.")
+	collectdWriteDeadline = flag.Duration("collectd_write_deadline", 0,
+		"Time to wait for each push to collectd to be written once connected.  If 0, metric_push_write_deadline is used.")
 
 	collectdExportTotal   = expvar.NewInt("collectd_export_total")
 	collectdExportSuccess = expvar.NewInt("collectd_export_success")
@@ -36,8 +45,8 @@ func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet) s
 		kindToCollectdType(m.Kind),
 		formatLabels(m.Name, l.Labels, "-", "-", "_"),
 		*pushInterval,
-		l.Datum.TimeString(),
-		l.Datum.ValueString())
+		pushTimeString(hostname, l),
+		pushValueString(l.Datum))
 }
 
 func kindToCollectdType(kind metrics.Kind) string {
@@ -46,3 +55,27 @@ func kindToCollectdType(kind metrics.Kind) string {
 	}
 	return "gauge"
 }
+
+// readCollectdReply reads the status line that the collectd unixsock plugin
+// sends in response to each PUTVAL command.  The line starts with a status
+// code, which is negative if the command failed, followed by a message.
+func readCollectdReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return errors.Wrap(err, "reading collectd reply")
+	}
+	line = strings.TrimSpace(line)
+	fields := strings.SplitN(line, " ", 2)
+	status, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return errors.Errorf("unexpected collectd reply %q", line)
+	}
+	if status < 0 {
+		reason := line
+		if len(fields) > 1 {
+			reason = fields[1]
+		}
+		return &rejectedError{reason}
+	}
+	return nil
+}
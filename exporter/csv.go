@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/google/mtail/metrics"
+)
+
+var (
+	csvExportPath = flag.String("csv_export_path", "",
+		"Path to a file to write metrics to on each push, as CSV with one row per series.")
+	csvExportAppend = flag.Bool("csv_export_append", false,
+		"If true, each push is appended to csv_export_path.  If false, the file is truncated on each push, so it only holds the latest push.")
+
+	csvExportTotal   = expvar.NewInt("csv_export_total")
+	csvExportSuccess = expvar.NewInt("csv_export_success")
+)
+
+// csvHeader is the first row of a CSV export file.
+var csvHeader = []string{"name", "labels_json", "value", "timestamp"}
+
+// openCSV opens the CSV file at the target address for a push, truncating it
+// unless csv_export_append is set, and writes the header row if the file is
+// empty.
+func openCSV(target pushOptions) (io.WriteCloser, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if *csvExportAppend {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(target.addr, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		w := csv.NewWriter(f)
+		if err := w.Write(csvHeader); err != nil {
+			f.Close()
+			return nil, err
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// metricToCSV encodes a series of a metric as a CSV row.  The labels,
+// including the program as the prog label, are encoded as a JSON object with
+// sorted keys.  The metric lock is held before entering this function.
+func metricToCSV(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	labels := make(map[string]string, len(l.Labels)+1)
+	for k, v := range l.Labels {
+		labels[k] = v
+	}
+	labels["prog"] = m.Program
+	// encoding/json sorts the keys of a map.
+	j, _ := json.Marshal(labels)
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{m.Name, string(j), pushValueString(l.Datum), pushTimeString(hostname, l)})
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestMetricToCSV(t *testing.T) {
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "path", "code")
+	d, _ := m.GetDatum("/a,b", "200")
+	datum.SetInt(d, 37, time.Unix(1343124840, 0))
+	r := FakeSocketWrite(metricToCSV, m)
+	expected := []string{`requests,"{""code"":""200"",""path"":""/a,b"",""prog"":""prog""}",37,1343124840` + "\n"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("row didn't match:\n%s", diff)
+	}
+}
+
+func TestPushCSV(t *testing.T) {
+	defer func(b bool) { *csvExportAppend = b }(*csvExportAppend)
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.csv")
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:       "csv",
+		addr:       path,
+		f:          metricToCSV,
+		open:       openCSV,
+		timestamps: true,
+		total:      new(expvar.Int),
+		success:    new(expvar.Int),
+	}
+	header := "name,labels_json,value,timestamp\n"
+	row := func(v string) string {
+		return `foo,"{""prog"":""prog""}",` + v + ",1343124840\n"
+	}
+	read := func() string {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("couldn't read %s: %s", path, err)
+		}
+		return string(b)
+	}
+
+	for _, v := range []int64{1, 2} {
+		datum.SetInt(d, v, time.Unix(1343124840, 0))
+		if err := e.pushTo(target); err != nil {
+			t.Fatalf("push failed: %s", err)
+		}
+	}
+	if diff := cmp.Diff(header+row("2"), read()); diff != "" {
+		t.Errorf("truncated file didn't match:\n%s", diff)
+	}
+
+	*csvExportAppend = true
+	datum.SetInt(d, 3, time.Unix(1343124840, 0))
+	if err := e.pushTo(target); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	if diff := cmp.Diff(header+row("2")+row("3"), read()); diff != "" {
+		t.Errorf("appended file didn't match:\n%s", diff)
+	}
+}
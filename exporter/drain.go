@@ -0,0 +1,50 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// drainReplies reads the lines that a target sends back during a push until
+// the connection is closed, so that they don't fill the receive buffer of the
+// connection and block the push.  Targets like this only reply to report an
+// error, so each line is logged and counted as a rejected series.  It
+// returns the number of lines read.
+func (e *Exporter) drainReplies(r io.Reader, target pushOptions) int {
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		n++
+		e.dropped.add(dropRejected, target.name, 1)
+		glog.V(1).Infof("%s replied: %s", target.addr, line)
+	}
+	return n
+}
+
+// waitForReplies closes the writing side of the connection, so the target
+// knows the push is finished, and waits for the replies to be drained.  If
+// the connection can't be half closed, it returns 0 without waiting, and the
+// drain ends when the connection is closed.
+func waitForReplies(conn io.Writer, drained <-chan int) int {
+	cw, ok := conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return 0
+	}
+	if err := cw.CloseWrite(); err != nil {
+		glog.Infof("Couldn't close the writing side of the connection: %s", err)
+		return 0
+	}
+	return <-drained
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestDeliverDrainReplies(t *testing.T) {
+	*graphitePrefix = ""
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+	// Reply with an error to each line with a bad value, like an OpenTSDB
+	// telnet server.
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		s := bufio.NewScanner(c)
+		for s.Scan() {
+			if strings.Contains(s.Text(), "bad") {
+				fmt.Fprintf(c, "error: %s\n", s.Text())
+			}
+		}
+	}()
+
+	ms := metrics.NewStore()
+	for _, name := range []string{"bad", "good"} {
+		m := metrics.NewMetric(name, "prog", metrics.Counter, metrics.Int)
+		d, _ := m.GetDatum()
+		datum.SetInt(d, 1, time.Unix(1343124840, 0))
+		ms.Add(m)
+	}
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "drain",
+		net:     "tcp",
+		addr:    l.Addr().String(),
+		f:       metricToGraphite,
+		drain:   true,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	if err := e.deliver(target, nil); err != nil {
+		t.Fatalf("deliver failed: %s", err)
+	}
+	if r := target.success.Value(); r != 1 {
+		t.Errorf("expected 1 series accepted, received %d", r)
+	}
+	if r := e.dropped.pending[dropKey{dropRejected, "drain"}]; r != 1 {
+		t.Errorf("expected 1 series rejected, received %d", r)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+const droppedName = "mtail_export_dropped_total"
+
+// Reasons that a series is dropped from a push.
+const (
+	dropBackfill          = "backfill"            // Older than the maximum backfill.
+	dropMinCount          = "min_count"           // A counter below the minimum count.
+	dropLabelFilter       = "label_filter"        // Missing the label required by the target.
+	dropRejected          = "rejected"            // Refused by the target.
+	dropSampled           = "sampled"             // Not in the sample of series pushed to the target.
+	dropTooManyDimensions = "too_many_dimensions" // More labels than the target allows.
+)
+
+// dropKey identifies a count of dropped series.
+type dropKey struct {
+	reason, target string
+}
+
+// droppedSeries counts the series dropped from pushes, by reason and target.
+// Drops are counted while the store is locked for a push, so they are added
+// to the metric after the push has finished.
+type droppedSeries struct {
+	m *metrics.Metric
+
+	mu      sync.Mutex
+	pending map[dropKey]int64 // Drops not yet added to the metric.
+}
+
+func newDroppedSeries() *droppedSeries {
+	return &droppedSeries{
+		m:       metrics.NewMetric(droppedName, "mtail", metrics.Counter, metrics.Int, "reason", "target"),
+		pending: make(map[dropKey]int64),
+	}
+}
+
+// add counts n series dropped from a push to the target.
+func (d *droppedSeries) add(reason, target string, n int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[dropKey{reason, target}] += n
+}
+
+// flush adds the pending drops to the metric.  No metric locks are held
+// before entering this function.
+func (d *droppedSeries) flush() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = make(map[dropKey]int64)
+	d.mu.Unlock()
+	now := time.Now()
+	for k, n := range pending {
+		dd, _ := d.m.GetDatum(k.reason, k.target)
+		datum.IncIntBy(dd, n, now)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestDroppedSeries(t *testing.T) {
+	defer func(d time.Duration) { *maxBackfill = d }(*maxBackfill)
+	*maxBackfill = time.Hour
+	*graphitePrefix = ""
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Int, "safe")
+	d, _ := m.GetDatum("true")
+	datum.SetInt(d, 1, time.Now().Add(-2*time.Hour))
+	d, _ = m.GetDatum("false")
+	datum.SetInt(d, 1, time.Now())
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:       "graphite",
+		f:          metricToGraphite,
+		timestamps: true,
+		require:    &labelRequirement{"safe", "true"},
+		total:      new(expvar.Int),
+		success:    new(expvar.Int),
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := e.writeSocketMetrics(&bytes.Buffer{}, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+	}
+	e.dropped.flush()
+
+	r := make(map[string]string)
+	lc := make(chan *metrics.LabelSet)
+	go e.dropped.m.EmitLabelSets(lc)
+	for l := range lc {
+		r[l.Labels["reason"]+"/"+l.Labels["target"]] = l.Datum.ValueString()
+	}
+	expected := map[string]string{"backfill/graphite": "2", "label_filter/graphite": "2"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("dropped series didn't match:\n%s", diff)
+	}
+}
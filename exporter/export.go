@@ -6,25 +6,53 @@
 package exporter
 
 import (
+	"bufio"
+	"database/sql"
 	"expvar"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 	"github.com/pkg/errors"
 )
 
+const heartbeatName = "mtail_push_heartbeat_total"
+
 // Commandline Flags.
 var (
 	pushInterval = flag.Int("metric_push_interval_seconds", 60,
 		"Interval between metric pushes, in seconds.")
-	writeDeadline = flag.Duration("metric_push_write_deadline", 10*time.Second, "Time to wait for a push to succeed before exiting with an error.")
+	writeDeadline  = flag.Duration("metric_push_write_deadline", 10*time.Second, "Time to wait for a push to succeed before exiting with an error.")
+	deadLetterFile = flag.String("metric_push_dead_letter_file", "",
+		"Path to a file to append series rejected by a push target to, with the reason for rejection.")
+	maxBackfill = flag.Duration("metric_push_max_backfill", 0,
+		"Points with a timestamp older than this are not pushed to targets that record the point's timestamp.  0 means no limit.")
+	kindOrder = flag.String("metric_push_kind_order", "",
+		"Comma separated list of metric kinds, e.g. gauge,counter, giving the order in which metrics are pushed.  Kinds not in the list are pushed last.  By default, and within each kind, metrics are pushed in name order.")
+	timestampJitter = flag.Duration("metric_push_timestamp_jitter", 0,
+		"If set, the timestamps of points pushed to collectd, graphite, TimescaleDB and InfluxDB are moved earlier by an offset of up to this duration, fixed for each host, so many hosts pushing at once don't write identical timestamps.  Must be less than the push interval.")
+	publicOnly = flag.Bool("metric_push_public_only", false,
+		"If true, only metrics declared public in their program, and mtail's own metrics, are pushed to push targets.  All metrics are still served on /metrics, /json and /varz.")
+	minCount = flag.Float64("metric_push_min_count", 0,
+		"Counter series with a value below this are not pushed to collectd, graphite or statsd.  Gauges and timers are always pushed.  0 pushes all counters.")
+	maxNameBytes = flag.Int("metric_push_max_name_bytes", 0,
+		"Maximum length in bytes of metric names pushed to graphite and statsd.  Longer names are truncated and a hash of the full name appended.  0 means no limit.")
+
+	exportRejected        = expvar.NewInt("metric_push_rejected_total")
+	exportBackfillSkipped = expvar.NewInt("metric_push_backfill_skipped_total")
+	exportMinCountSkipped = expvar.NewMap("metric_push_min_count_skipped_total")
 )
 
 // Exporter manages the export of metrics to passive and active collectors.
@@ -32,13 +60,54 @@ type Exporter struct {
 	store       *metrics.Store
 	o           Options
 	pushTargets []pushOptions
+
+	deadLetterMu sync.Mutex // guards writes to deadLetter
+	deadLetter   io.Writer  // Destination for rejected series, if not nil.
+
+	db     *sql.DB        // Timescale database to insert metrics into, if not nil.
+	azure  *azureClient   // Azure Monitor client, if not nil.
+	amqp   *amqpPublisher // AMQP publisher, if not nil.
+	influx *influxClient  // InfluxDB 2 client, if not nil.
+
+	kindRank map[metrics.Kind]int // Push order of metric kinds, if not nil.
+
+	cardinality *metrics.Metric // Label cardinality metric, if enabled.
+
+	targetHealth *metrics.Metric // Count of push targets in each state, if enabled.
+
+	cycle int64 // Count of pushes before the current one.
+
+	heartbeatOnce sync.Once
+	heartbeat     datum.Datum    // Count of pushes, including the current one.
+	dropped       *droppedSeries // Count of series dropped from pushes.
+
+	typeConflicts *typeConflicts // Count of metrics skipped from /metrics for conflicting types.
+
+	stream *diffStream // Stream of changed series, if not nil.
+
+	hashLabels map[string]uint32 // Number of buckets to hash the values of each label into.
+
+	maintenance maintenanceWindow // Planned maintenance of the push targets.
+
+	baselines *baselines // Baselines subtracted from pushed values, if not nil.
+
+	retryBudget *retryBudget // Rate limit of retries across all targets, if not nil.
+
+	memory memoryState // Targets degraded because memory is short.
+
+	constLabels map[string]string // Labels added to every series, if not nil.
+
+	routes *routeTable // Routes from metrics to push targets, if not nil.
+
+	lastSuccessMu sync.RWMutex         // guards lastSuccess
+	lastSuccess   map[string]time.Time // Time of the last successful push to each target, by name.
 }
 
 // Options contains the required and optional parameters for constructing an
 // Exporter.
 type Options struct {
 	Store         *metrics.Store
-	Hostname      string // Not required, uses os.Hostname if zero.
+	Hostname      string // Not required; see resolveHostname for the fallbacks if zero.
 	OmitProgLabel bool   // If true, don't emit the prog label that identifies the source program in variable exports.
 }
 
@@ -47,40 +116,307 @@ func New(o Options) (*Exporter, error) {
 	if o.Store == nil {
 		return nil, errors.New("exporter needs a Store")
 	}
-	if o.Hostname == "" {
+	var err error
+	o.Hostname, err = resolveHostname(o.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{store: o.Store, o: o, dropped: newDroppedSeries(), typeConflicts: newTypeConflicts(), lastSuccess: make(map[string]time.Time)}
+
+	if *kindOrder != "" {
+		var err error
+		e.kindRank, err = parseKindOrder(*kindOrder)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if *timestampJitter >= time.Duration(*pushInterval)*time.Second {
+		return nil, errors.Errorf("metric_push_timestamp_jitter %s must be less than the push interval of %ds", *timestampJitter, *pushInterval)
+	}
+
+	t, err := parseNameTransforms(*graphiteNameTransforms)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing graphite_name_transforms")
+	}
+	graphiteNameTransform = t
+
+	var renames map[string]string
+	if *renameFile != "" {
+		renames, err = loadRenames(*renameFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading metric_push_rename_file")
+		}
+	}
+	renamed, err := parseRenameTargets(*renameTargets)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing metric_push_rename_targets")
+	}
+	if *routeFile != "" {
+		e.routes, err = loadRoutes(*routeFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading metric_push_route_file")
+		}
+	}
+
+	e.constLabels, err = constLabels(BuildLabels, *extraLabels)
+	if err != nil {
+		return nil, err
+	}
+	e.baselines = newBaselines(*baselineMetrics)
+	if *retryBudgetPerSecond > 0 {
+		e.retryBudget = newRetryBudget(*retryBudgetPerSecond)
+	}
+
+	e.hashLabels, err = parseHashLabels(*hashLabels)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing metric_push_hash_label")
+	}
+
+	if *metricStream {
+		e.stream = newDiffStream()
+	}
+
+	if *emitLabelCardinality {
+		var err error
+		e.cardinality, err = newLabelCardinality(e.store)
+		if err != nil {
+			return nil, errors.Wrap(err, "adding label cardinality metric")
+		}
+	}
+
+	if *emitTargetHealth {
 		var err error
-		o.Hostname, err = os.Hostname()
+		e.targetHealth, err = newTargetHealth(e.store)
+		if err != nil {
+			return nil, errors.Wrap(err, "adding target health metric")
+		}
+	}
+
+	if *deadLetterFile != "" {
+		f, err := os.OpenFile(*deadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
-			return nil, errors.Wrap(err, "getting hostname")
+			return nil, errors.Wrap(err, "opening dead letter file")
 		}
+		e.deadLetter = f
 	}
-	e := &Exporter{store: o.Store, o: o}
 
 	if *collectdSocketPath != "" {
-		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess}
+		require, err := parseLabelRequirement(*collectdRequireLabel)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing collectd_require_label")
+		}
+		o := pushOptions{
+			name:       "collectd",
+			net:        "unix",
+			addr:       *collectdSocketPath,
+			f:          metricToCollectd,
+			reply:      readCollectdReply,
+			timestamps: true,
+			require:    require,
+			minCount:   *minCount,
+			dial:       *collectdDialTimeout,
+			deadline:   *collectdWriteDeadline,
+			total:      collectdExportTotal,
+			success:    collectdExportSuccess,
+		}
 		e.RegisterPushExport(o)
 	}
 	if *graphiteHostPort != "" {
-		o := pushOptions{"tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess}
-		e.RegisterPushExport(o)
+		require, err := parseLabelRequirement(*graphiteRequireLabel)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing graphite_require_label")
+		}
+		if *graphiteSampleRate <= 0 || *graphiteSampleRate > 1 {
+			return nil, errors.Errorf("graphite_series_sample_rate %v must be more than 0 and at most 1", *graphiteSampleRate)
+		}
+		if *graphiteFloatFormat != "f" && *graphiteFloatFormat != "g" {
+			return nil, errors.Errorf("graphite_float_format %q must be f or g", *graphiteFloatFormat)
+		}
+		targets, err := parseGraphiteTargets(*graphiteHostPort, *graphiteHostPosition)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range targets {
+			o := pushOptions{
+				name:       "graphite",
+				net:        "tcp",
+				addr:       t.addr,
+				f:          graphiteFormatter(t.position),
+				timestamps: true,
+				conns:      *graphiteParallelConns,
+				drain:      *graphiteDrainReplies,
+				align:      *graphiteAlignTimestamps,
+				require:    require,
+				minCount:   *minCount,
+				sampleRate: *graphiteSampleRate,
+				dial:       *graphiteDialTimeout,
+				deadline:   *graphiteWriteDeadline,
+				total:      graphiteExportTotal,
+				success:    graphiteExportSuccess,
+			}
+			if len(targets) > 1 {
+				// Each server needs its own name so that its health and
+				// retries are tracked apart from the others.
+				o.family = o.name
+				o.name += "@" + t.addr
+			}
+			e.RegisterPushExport(o)
+		}
 	}
 	if *statsdHostPort != "" {
-		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
+		require, err := parseLabelRequirement(*statsdRequireLabel)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing statsd_require_label")
+		}
+		o := pushOptions{
+			name:     "statsd",
+			net:      "udp",
+			addr:     *statsdHostPort,
+			f:        metricToStatsd,
+			require:  require,
+			minCount: *minCount,
+			sndbuf:   *statsdUDPSndbuf,
+			dial:     *statsdDialTimeout,
+			deadline: *statsdWriteDeadline,
+			total:    statsdExportTotal,
+			success:  statsdExportSuccess,
+		}
+		e.RegisterPushExport(o)
+	}
+	if *fifoExportPath != "" {
+		o := pushOptions{
+			name:       "fifo",
+			addr:       *fifoExportPath,
+			f:          metricToFIFO,
+			open:       openFIFO,
+			timestamps: true,
+			total:      fifoExportTotal,
+			success:    fifoExportSuccess,
+		}
 		e.RegisterPushExport(o)
 	}
+	if *csvExportPath != "" {
+		o := pushOptions{
+			name:       "csv",
+			addr:       *csvExportPath,
+			f:          metricToCSV,
+			open:       openCSV,
+			timestamps: true,
+			total:      csvExportTotal,
+			success:    csvExportSuccess,
+		}
+		e.RegisterPushExport(o)
+	}
+	if renames != nil {
+		for i := range e.pushTargets {
+			if renamed[e.pushTargets[i].familyName()] {
+				e.pushTargets[i].renames = renames
+			}
+		}
+	}
+	if *timescaleDSN != "" {
+		db, err := openTimescale(*timescaleDSN)
+		if err != nil {
+			return nil, err
+		}
+		e.db = db
+	}
+	if *azureMonitor {
+		e.azure = newAzureClient(*azureRegion, *azureResourceID)
+	}
+	if *amqpURL != "" {
+		e.amqp = newAMQPPublisher(*amqpURL, *amqpExchange, *amqpRoutingKey)
+	}
+	if *influxURL != "" {
+		e.influx, err = newInfluxClient(*influxURL, *influxOrg, *influxBucket, *influxToken)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return e, nil
 }
 
+// parseKindOrder parses a comma separated list of metric kinds into the rank
+// of each kind.
+func parseKindOrder(order string) (map[metrics.Kind]int, error) {
+	kinds := map[string]metrics.Kind{}
+	for _, k := range []metrics.Kind{metrics.Counter, metrics.Gauge, metrics.Timer} {
+		kinds[strings.ToLower(k.String())] = k
+	}
+	rank := make(map[metrics.Kind]int)
+	for i, name := range strings.Split(order, ",") {
+		k, ok := kinds[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, errors.Errorf("unknown metric kind %q in metric_push_kind_order", name)
+		}
+		if _, ok := rank[k]; ok {
+			return nil, errors.Errorf("metric kind %q repeated in metric_push_kind_order", name)
+		}
+		rank[k] = i
+	}
+	return rank, nil
+}
+
+// orderedMetricNames returns the names of the metrics in the store in the
+// order they are pushed: by kind if a kind order is configured, and then by
+// name.  The store lock is held before entering this function.
+func (e *Exporter) orderedMetricNames() []string {
+	names := make([]string, 0, len(e.store.Metrics))
+	for name := range e.store.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if e.kindRank == nil {
+		return names
+	}
+	ranked := byKindRank{names: names, ranks: make([]int, len(names))}
+	for i, name := range names {
+		ranked.ranks[i] = len(e.kindRank)
+		ml := e.store.Metrics[name]
+		if len(ml) == 0 {
+			continue
+		}
+		// The store ensures all metrics with the same name have the same kind.
+		if r, ok := e.kindRank[ml[0].Kind]; ok {
+			ranked.ranks[i] = r
+		}
+	}
+	sort.Stable(ranked)
+	return names
+}
+
+// byKindRank sorts metric names by the rank of their kind in the push order.
+type byKindRank struct {
+	names []string
+	ranks []int // Rank of the kind of each metric in names.
+}
+
+func (b byKindRank) Len() int           { return len(b.names) }
+func (b byKindRank) Less(i, j int) bool { return b.ranks[i] < b.ranks[j] }
+func (b byKindRank) Swap(i, j int) {
+	b.names[i], b.names[j] = b.names[j], b.names[i]
+	b.ranks[i], b.ranks[j] = b.ranks[j], b.ranks[i]
+}
+
 // formatLabels converts a metric name and key-value map of labels to a single
 // string for exporting to the correct output format for each export target.
 // ksep and sep mark what to use for key/val separator, and between label separators respoectively.
 // If not empty, rep is used to replace cases of ksep and sep in the original strings.
+// Labels are written in order of their keys, so a series always has the same
+// path.
 func formatLabels(name string, m map[string]string, ksep, sep, rep string) string {
 	r := name
 	if len(m) > 0 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
 		var s []string
-		for k, v := range m {
+		for _, k := range keys {
+			v := m[k]
 			k1 := strings.Replace(strings.Replace(k, ksep, rep, -1), sep, rep, -1)
 			v1 := strings.Replace(strings.Replace(v, ksep, rep, -1), sep, rep, -1)
 			s = append(s, fmt.Sprintf("%s%s%s", k1, ksep, v1))
@@ -90,65 +426,581 @@ func formatLabels(name string, m map[string]string, ksep, sep, rep string) strin
 	return r
 }
 
+// truncatedLogInterval is the least time between logs of truncated names.
+const truncatedLogInterval = time.Minute
+
+var (
+	exportNamesTruncated = expvar.NewInt("metric_push_names_truncated_total")
+
+	truncatedMu     sync.Mutex
+	truncatedLogged time.Time // Time a truncated name was last logged.
+)
+
+// truncateName shortens name to the length set by the
+// metric_push_max_name_bytes flag.  A hash of the full name replaces the end
+// of the name, so that names sharing a long common prefix remain distinct.
+// Each truncation is counted, and at most one is logged a minute, as names
+// built from label values can be too many to log or remember.
+func truncateName(name string) string {
+	max := *maxNameBytes
+	if max <= 0 || len(name) <= max {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+	var t string
+	if max <= len(suffix) {
+		t = suffix[len(suffix)-max:]
+	} else {
+		keep := max - len(suffix)
+		// Don't cut a multibyte character in half.
+		for keep > 0 && !utf8.RuneStart(name[keep]) {
+			keep--
+		}
+		t = name[:keep] + suffix
+	}
+	exportNamesTruncated.Add(1)
+	truncatedMu.Lock()
+	defer truncatedMu.Unlock()
+	if now := time.Now(); now.Sub(truncatedLogged) >= truncatedLogInterval {
+		truncatedLogged = now
+		glog.Infof("Metric name %q longer than %d bytes, truncated to %q; %d names truncated so far", name, max, t, exportNamesTruncated.Value())
+	}
+	return t
+}
+
+// datumValue returns the value of a Datum as a float64.
+func datumValue(d datum.Datum) float64 {
+	switch d.Type() {
+	case datum.Float:
+		return datum.GetFloat(d)
+	default:
+		return float64(datum.GetInt(d))
+	}
+}
+
+// tooOld reports whether the LabelSet was last updated longer ago than the
+// metric_push_max_backfill flag allows.  When mtail is reading old logs, the
+// metric timestamps are the time of the log lines, and pushing them to a
+// timestamp aware backend backfills it.
+func tooOld(l *metrics.LabelSet, now time.Time) bool {
+	if *maxBackfill <= 0 {
+		return false
+	}
+	if now.Sub(l.Datum.TimeUTC()) > *maxBackfill {
+		exportBackfillSkipped.Add(1)
+		return true
+	}
+	return false
+}
+
+// jitterOffset returns the timestamp jitter offset of the host.
+func jitterOffset(hostname string) time.Duration {
+	if *timestampJitter <= 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	return time.Duration(uint64(h.Sum32()) % uint64(*timestampJitter))
+}
+
+// pushTime returns the timestamp of a point to push, moved earlier by the
+// timestamp jitter offset of the host.
+func pushTime(hostname string, l *metrics.LabelSet) time.Time {
+	return l.Datum.TimeUTC().Add(-jitterOffset(hostname))
+}
+
+// pushTimeString returns the timestamp of a point to push in seconds since the
+// epoch.
+func pushTimeString(hostname string, l *metrics.LabelSet) string {
+	if *timestampJitter <= 0 {
+		return l.Datum.TimeString()
+	}
+	return strconv.FormatInt(pushTime(hostname, l).Unix(), 10)
+}
+
+// sampled returns true if the series is in the given fraction of series to
+// push.  The choice depends only on the program, name and labels of the
+// series, so the same series are chosen on every push.
+func sampled(m *metrics.Metric, l *metrics.LabelSet, rate float64) bool {
+	keys := make([]string, 0, len(l.Labels))
+	for k := range l.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s", m.Program, m.Name)
+	for _, k := range keys {
+		fmt.Fprintf(h, "\x00%s=%s", k, l.Labels[k])
+	}
+	return float64(h.Sum32()) < rate*(1<<32)
+}
+
+// belowMinCount returns true if the series is a counter whose value is below
+// min, the minimum count to be pushed.
+func belowMinCount(m *metrics.Metric, l *metrics.LabelSet, min float64) bool {
+	return min > 0 && m.Kind == metrics.Counter && datumValue(l.Datum) < min
+}
+
 // Format a LabelSet into a string to be written to one of the timeseries
 // sockets.
 type formatter func(string, *metrics.Metric, *metrics.LabelSet) string
 
-func (e *Exporter) writeSocketMetrics(c io.Writer, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
+// replyReader reads the server's reply to a single line written to a push
+// target that acknowledges each line.  A rejectedError is returned if the
+// server refused the line, and any other error is a transport failure.
+type replyReader func(*bufio.Reader) error
+
+// rejectedError describes a series that was rejected by the push target.  The
+// push continues past rejected series.
+type rejectedError struct {
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return "rejected: " + e.reason
+}
+
+// writeSocketMetrics writes all the metrics in the store to c, formatted for
+// the target, and returns the number of lines successfully written.  If the
+// target acknowledges each line, c must also be an io.Reader from which the
+// replies are read.
+func (e *Exporter) writeSocketMetrics(c io.Writer, target pushOptions) (int, error) {
+	var replies *bufio.Reader
+	if target.reply != nil {
+		r, ok := c.(io.Reader)
+		if !ok {
+			return 0, errors.Errorf("can't read replies from %s", target.addr)
+		}
+		replies = bufio.NewReader(r)
+	}
+
 	e.store.RLock()
 	defer e.store.RUnlock()
 
-	for _, ml := range e.store.Metrics {
-		for _, m := range ml {
-			m.RLock()
-			exportTotal.Add(1)
-			lc := make(chan *metrics.LabelSet)
-			go m.EmitLabelSets(lc)
-			for l := range lc {
-				line := f(e.o.Hostname, m, l)
-				n, err := fmt.Fprint(c, line)
-				glog.V(2).Infof("Sent %d bytes\n", n)
-				if err == nil {
-					exportSuccess.Add(1)
-				} else {
-					return errors.Errorf("write error: %s\n", err)
+	count := 0
+	for _, name := range e.orderedMetricNames() {
+		if target.conns > 1 && shardOf(name, target.conns) != target.shard {
+			continue
+		}
+		for _, m := range e.store.Metrics[name] {
+			if !e.pushes(m, target.familyName()) {
+				continue
+			}
+			n, err := e.writeMetric(c, replies, target, m)
+			count += n
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// pushThisCycle returns true if the metric is due to be pushed on the current
+// push, as metrics declared with an export interval multiplier of N are only
+// pushed on every Nth push, starting with the first.  If
+// metric_push_public_only is set, only metrics declared public are pushed.
+func (e *Exporter) pushThisCycle(m *metrics.Metric) bool {
+	if *publicOnly && !m.Public {
+		return false
+	}
+	return m.ExportEvery <= 1 || e.cycle%m.ExportEvery == 0
+}
+
+// pushes returns true if the metric is pushed to the named target on the
+// current push.
+func (e *Exporter) pushes(m *metrics.Metric, target string) bool {
+	return e.pushThisCycle(m) && exportsTo(m, target)
+}
+
+// exportsTo returns true if the metric is exported to the named target: if
+// the metric was declared with export_to, the target must be in its list.
+func exportsTo(m *metrics.Metric, target string) bool {
+	if len(m.ExportTo) == 0 {
+		return true
+	}
+	for _, t := range m.ExportTo {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// shardOf returns the shard of n that the metric named name is written to.
+func shardOf(name string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(n))
+}
+
+// writeMetric writes each LabelSet of the metric m to c, reading replies from
+// r if the target sends them.  It returns the number of lines successfully
+// written.
+func (e *Exporter) writeMetric(c io.Writer, r *bufio.Reader, target pushOptions, m *metrics.Metric) (int, error) {
+	pm, ok := e.routes.metric(m, target.familyName())
+	if !ok {
+		return 0, nil
+	}
+	if name, ok := target.renames[pm.Name]; ok {
+		pm = renamedMetric(pm, name)
+	}
+	m.RLock()
+	defer m.RUnlock()
+	target.total.Add(1)
+	count := 0
+	now := time.Now()
+	lc := make(chan *metrics.LabelSet)
+	go e.emitLabelSets(m, lc)
+	var sets <-chan *metrics.LabelSet = lc
+	if e.hashesLabels(m) {
+		sets = e.bucketLabelSets(m, lc)
+	}
+	var ts *metrics.Metric
+	if *timestampSeries {
+		ts = timestampMetric(pm)
+	}
+	baselined := e.baselines.applies(m)
+	for l := range sets {
+		if baselined {
+			l = e.baselines.subtract(m, l)
+		}
+		if target.timestamps && ts == nil && target.alignTo.IsZero() && tooOld(l, now) {
+			e.dropped.add(dropBackfill, target.name, 1)
+			continue
+		}
+		if belowMinCount(m, l, target.minCount) {
+			exportMinCountSkipped.Add(target.name, 1)
+			e.dropped.add(dropMinCount, target.name, 1)
+			continue
+		}
+		if target.require != nil && !target.require.matches(l) {
+			exportLabelFiltered.Add(target.name, 1)
+			e.dropped.add(dropLabelFilter, target.name, 1)
+			continue
+		}
+		if target.sampleRate > 0 && target.sampleRate < 1 && !sampled(m, l, target.sampleRate) {
+			e.dropped.add(dropSampled, target.name, 1)
+			continue
+		}
+		points := []point{{pm, l}}
+		if ts != nil {
+			points = timestampPoints(pm, ts, l, now)
+		}
+		for _, p := range points {
+			if !target.alignTo.IsZero() {
+				// The formatter moves the timestamp earlier by the jitter
+				// offset, so add it back: an aligned point must stay at the
+				// start of its interval rather than fall into the previous
+				// one, so it isn't jittered.
+				p.l = retime(p.l, target.alignTo.Add(jitterOffset(e.o.Hostname)))
+			}
+			line := target.f(e.o.Hostname, p.m, p.l)
+			n, err := fmt.Fprint(c, line)
+			glog.V(2).Infof("Sent %d bytes\n", n)
+			if err == nil && r != nil {
+				err = target.reply(r)
+			}
+			switch err := err.(type) {
+			case nil:
+				count++
+			case *rejectedError:
+				e.writeDeadLetter(target, line, err.reason)
+			default:
+				// Drain the remaining LabelSets so the emitting goroutine exits.
+				for range sets {
 				}
+				return count, errors.Errorf("write error: %s\n", err)
 			}
-			m.RUnlock()
 		}
 	}
-	return nil
+	return count, nil
+}
+
+// writeDeadLetter records a line rejected by the target, and the reason given
+// by the target, to the dead letter file.
+func (e *Exporter) writeDeadLetter(target pushOptions, line, reason string) {
+	exportRejected.Add(1)
+	e.dropped.add(dropRejected, target.name, 1)
+	glog.V(1).Infof("%s rejected %q: %s", target.addr, line, reason)
+	if e.deadLetter == nil {
+		return
+	}
+	e.deadLetterMu.Lock()
+	defer e.deadLetterMu.Unlock()
+	_, err := fmt.Fprintf(e.deadLetter, "%s\t%s\t%s\t%s\n",
+		time.Now().UTC().Format(time.RFC3339),
+		target.addr,
+		reason,
+		strings.TrimRight(line, "\n"))
+	if err != nil {
+		glog.Infof("dead letter write error: %s", err)
+	}
 }
 
 // PushMetrics sends metrics to each of the configured services.
 func (e *Exporter) PushMetrics() {
-	for _, target := range e.pushTargets {
-		glog.V(2).Infof("pushing to %s", target.addr)
-		conn, err := net.DialTimeout(target.net, target.addr, *writeDeadline)
-		if err != nil {
-			glog.Infof("pusher dial error: %s", err)
-			continue
+	defer func() { e.cycle++ }()
+	e.beat()
+	e.updateLabelCardinality()
+	e.updateTargetHealth(time.Now())
+	targets := e.targets()
+	accepted := false
+	for _, target := range targets {
+		if e.pushToTarget(target) {
+			accepted = true
 		}
-		err = conn.SetDeadline(time.Now().Add(*writeDeadline))
+	}
+	if e.stream != nil {
+		e.stream.publish(e.store)
+	}
+	if accepted || len(targets) == 0 {
+		// If every target failed, the series are kept for the next push, so
+		// the values of this interval aren't lost.
+		e.resetExported()
+	}
+	e.dropped.flush()
+}
+
+// pushToTarget sends the store to the target, and records the success of the
+// push for the health of the target.  While a maintenance window is open,
+// failures are only logged at verbosity 1, and the push isn't recorded, so the
+// health of the target doesn't change.  It returns true if the target accepted
+// the push, or queued it to send once the window closes.
+func (e *Exporter) pushToTarget(t pushTarget) bool {
+	name := t.targetName()
+	glog.V(2).Infof("pushing to %s", name)
+	err := t.push(e)
+	if e.maintenance.open(time.Now()) {
 		if err != nil {
-			glog.Infof("Couldn't set deadline on connection: %s", err)
+			glog.V(1).Infof("%s push error: %s", name, err)
 		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
-		if err != nil {
-			glog.Infof("pusher write error: %s", err)
+		return err == nil || err == errMaintenance
+	}
+	if err != nil {
+		glog.Infof("%s push error: %s", name, err)
+		return false
+	}
+	e.recordSuccess(name)
+	return true
+}
+
+// resetExported removes the series of metrics declared reset_after_export
+// that were pushed on this push, so they are only exported again once updated.
+// It is only called once a push has been accepted by at least one target.
+func (e *Exporter) resetExported() {
+	e.store.RLock()
+	defer e.store.RUnlock()
+	for _, ml := range e.store.Metrics {
+		for _, m := range ml {
+			if !m.ResetAfterExport || !e.pushThisCycle(m) {
+				continue
+			}
+			m.Lock()
+			m.LabelValues = make([]*metrics.LabelValue, 0)
+			m.Unlock()
 		}
-		err = conn.Close()
-		if err != nil {
+	}
+}
+
+// beat increments the push heartbeat counter.  On the first push, it adds the
+// heartbeat and dropped series metrics to the store, so that they are only
+// exported by an mtail that is pushing.
+func (e *Exporter) beat() {
+	e.heartbeatOnce.Do(func() {
+		m := metrics.NewMetric(heartbeatName, "mtail", metrics.Counter, metrics.Int)
+		e.heartbeat, _ = m.GetDatum()
+		for _, m := range []*metrics.Metric{m, e.dropped.m} {
+			m.Public = true
+			if err := e.store.Add(m); err != nil {
+				glog.Infof("Couldn't add %s to the store: %s", m.Name, err)
+			}
+		}
+	})
+	datum.IncIntBy(e.heartbeat, 1, time.Now())
+}
+
+// pushTo sends the store to the target.  If the target has several
+// connections, the metrics are sharded between them and written in parallel,
+// and the push succeeds only if all connections succeed.  If the target aligns
+// timestamps, every shard uses the start of the current push interval.
+func (e *Exporter) pushTo(target pushOptions) error {
+	if target.align {
+		target.alignTo = time.Now().Truncate(time.Duration(*pushInterval) * time.Second)
+	}
+	shards := target.conns
+	if shards < 1 {
+		shards = 1
+	}
+	errs := make(chan error, shards)
+	for i := 0; i < shards; i++ {
+		shard := target
+		shard.shard, shard.conns = i, shards
+		go func() {
+			errs <- e.pushShard(shard)
+		}()
+	}
+	var err error
+	for i := 0; i < shards; i++ {
+		if serr := <-errs; serr != nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// pushShard writes the target's shard of the store to the target.  If the
+// target has a retry queue, the shard is added to the queue, and all queued
+// pushes are written.  If that fails and leaves the queue above its high water
+// mark, another attempt to write the queue is started straight away, rather
+// than waiting for the next push.  Each retry of earlier pushes takes a token
+// from the retry budget, and if there is none the earlier pushes are dropped.
+// While a maintenance window is open, the shard is only added to the queue.
+// If memory is short, the shard is written without buffering or queueing.
+func (e *Exporter) pushShard(target pushOptions) error {
+	if target.queues != nil || target.buffered() {
+		e.checkMemory(&target)
+	}
+	var q *retryQueue
+	if target.queues != nil {
+		q = target.queues[target.shard]
+		b := &lineBatch{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			return err
+		}
+		q.add(b)
+		if e.maintenance.open(time.Now()) {
+			q.evict()
+			return errMaintenance
+		}
+		if q.retries() && !e.retryBudget.take(time.Now()) {
+			retryBudgetDropped.Add(target.name, int64(q.discardRetries()))
+		}
+	}
+	err := e.deliver(target, q)
+	if err != nil && q.aboveHighWater() && e.retryBudget.take(time.Now()) {
+		retryQueueHighWater.Add(target.name, 1)
+		go func() {
+			if err := e.deliver(target, q); err != nil {
+				glog.Infof("high water flush to %s failed: %s", target.addr, err)
+			}
+		}()
+	}
+	return err
+}
 
+// deliver makes a connection to the target and writes either the queued
+// pushes, if q is not nil, or the target's shard of the store to it.
+func (e *Exporter) deliver(target pushOptions, q *retryQueue) error {
+	var conn io.WriteCloser
+	var err error
+	if target.open != nil {
+		conn, err = target.open(target)
+	} else {
+		conn, err = net.DialTimeout(target.net, target.addr, target.dialTimeout())
+	}
+	if err != nil {
+		if q != nil {
+			q.evict()
+		}
+		return errors.Wrap(err, "pusher dial error")
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
 			glog.Infof("connection close failed: %s", err)
 		}
+	}()
+	if c, ok := conn.(*net.UDPConn); ok && target.sndbuf > 0 {
+		if err := setSendBuffer(c, target.sndbuf); err != nil {
+			glog.Infof("Couldn't set send buffer on connection: %s", err)
+		}
+	}
+	if d, ok := conn.(interface {
+		SetDeadline(time.Time) error
+	}); ok {
+		if err := d.SetDeadline(time.Now().Add(target.writeDeadline())); err != nil {
+			glog.Infof("Couldn't set deadline on connection: %s", err)
+		}
+	}
+	var drained chan int
+	if r, ok := conn.(io.Reader); ok && target.drain {
+		drained = make(chan int, 1)
+		go func() {
+			drained <- e.drainReplies(r, target)
+		}()
+	}
+	var w io.Writer = conn
+	var fw *flushWriter
+	if target.buffered() {
+		fw = newFlushWriter(conn, flushEvery)
+		w = fw
+	}
+	var n, replayed int
+	if q != nil {
+		n, replayed, err = q.flush(w)
+	} else {
+		n, err = e.writeSocketMetrics(w, target)
+	}
+	if fw != nil {
+		if err == nil {
+			err = fw.Flush()
+		}
+		if err != nil {
+			// Lines still in the buffer were not delivered.
+			n -= fw.pending
+		}
+	}
+	if drained != nil && err == nil {
+		// Series the target replied to were not accepted.
+		if n -= waitForReplies(conn, drained); n < 0 {
+			n = 0
+		}
 	}
+	// Replayed lines are written first, so any lines not delivered are
+	// counted against the latest push.
+	if replayed > n {
+		replayed = n
+	}
+	target.success.Add(int64(n - replayed))
+	if replayed > 0 {
+		retryReplayed.Add(target.name, int64(replayed))
+	}
+	return errors.Wrap(err, "pusher write error")
+}
+
+// dialTimeout returns the time to wait to connect to the target.
+func (p pushOptions) dialTimeout() time.Duration {
+	if p.dial > 0 {
+		return p.dial
+	}
+	return *writeDeadline
+}
+
+// writeDeadline returns the time to wait for a push to be written to the
+// target once connected.
+func (p pushOptions) writeDeadline() time.Duration {
+	if p.deadline > 0 {
+		return p.deadline
+	}
+	return *writeDeadline
+}
+
+// buffered reports whether pushes to the target are buffered and flushed
+// according to the metric_push_flush_every flag.  Only stream targets that
+// don't reply to each line are buffered.
+func (p pushOptions) buffered() bool {
+	return flushEvery.enabled() && p.reply == nil && p.net != "udp" && !p.unbuffered
 }
 
 // StartMetricPush pushes metrics to the configured services each interval.
 func (e *Exporter) StartMetricPush() {
-	if len(e.pushTargets) > 0 {
+	if len(e.targetNames()) > 0 || e.stream != nil {
 		glog.Info("Started metric push.")
+		if *warmupConns {
+			go e.warmup()
+		}
 		ticker := time.NewTicker(time.Duration(*pushInterval) * time.Second)
 		go func() {
 			for range ticker.C {
@@ -159,14 +1011,112 @@ func (e *Exporter) StartMetricPush() {
 }
 
 type pushOptions struct {
+	name           string            // Identifies the target in status and logs.
+	family         string            // Name that export_to and routes refer to the target by, if not its name.
+	renames        map[string]string // External names of metrics pushed to the target, by internal name, if not nil.
 	net, addr      string
 	f              formatter
+	open           func(pushOptions) (io.WriteCloser, error) // Opens the target; if nil, net and addr are dialled.
+	reply          replyReader                               // If not nil, the target replies to each line written.
+	timestamps     bool                                      // If true, the target records the timestamp of each point written.
+	conns          int                                       // Number of connections to shard the metrics across.
+	shard          int                                       // Shard of the metrics written on this connection, if conns > 1.
+	queues         []*retryQueue                             // Failed pushes to retry, for each shard, if not nil.
+	require        *labelRequirement                         // If not nil, only series with this label are pushed.
+	minCount       float64                                   // Counter series below this are not pushed, if more than 0.
+	dial, deadline time.Duration                             // Dial timeout and write deadline; if 0, writeDeadline is used.
+	sampleRate     float64                                   // Fraction of series pushed, if between 0 and 1.
+	sndbuf         int                                       // Size of the UDP socket send buffer, if not 0.
+	drain          bool                                      // If true, lines sent back by the target are read and counted as errors.
+	unbuffered     bool                                      // If true, the push is not buffered, as memory is short.
+	align          bool                                      // If true, points are timestamped with the start of the push interval.
+	alignTo        time.Time                                 // Start of the push interval of the current push, if align is set.
 	total, success *expvar.Int
 }
 
+// recordSuccess notes that a push to the named target has just succeeded.
+func (e *Exporter) recordSuccess(name string) {
+	e.lastSuccessMu.Lock()
+	defer e.lastSuccessMu.Unlock()
+	e.lastSuccess[name] = time.Now()
+}
+
+// familyName returns the name that export_to and routes refer to the target
+// by.
+func (p pushOptions) familyName() string {
+	if p.family != "" {
+		return p.family
+	}
+	return p.name
+}
+
+// pushTarget is a destination that the store is pushed to on each push.
+// Targets that are written lines over a connection are described by
+// pushOptions; the others are clientTargets.
+type pushTarget interface {
+	targetName() string     // Identifies the target in status and logs.
+	push(e *Exporter) error // Sends the store to the target.
+}
+
+func (p pushOptions) targetName() string     { return p.name }
+func (p pushOptions) push(e *Exporter) error { return e.pushTo(p) }
+
+// clientTarget is a push target with a client of its own, like a database or
+// an HTTP API, that writes the whole store in one go.
+type clientTarget struct {
+	name  string
+	write func(*Exporter) error
+}
+
+func (c clientTarget) targetName() string     { return c.name }
+func (c clientTarget) push(e *Exporter) error { return c.write(e) }
+
+// targets returns all the configured push targets.
+func (e *Exporter) targets() []pushTarget {
+	var targets []pushTarget
+	for _, target := range e.pushTargets {
+		targets = append(targets, target)
+	}
+	if e.db != nil {
+		targets = append(targets, clientTarget{timescaleTargetName, (*Exporter).writeTimescaleMetrics})
+	}
+	if e.azure != nil {
+		targets = append(targets, clientTarget{azureTargetName, (*Exporter).writeAzureMetrics})
+	}
+	if e.amqp != nil {
+		targets = append(targets, clientTarget{amqpTargetName, (*Exporter).writeAMQPMetrics})
+	}
+	if e.influx != nil {
+		targets = append(targets, clientTarget{influxTargetName, (*Exporter).writeInfluxMetrics})
+	}
+	return targets
+}
+
+// targetNames returns the names of all the configured push targets.
+func (e *Exporter) targetNames() []string {
+	var names []string
+	for _, target := range e.targets() {
+		names = append(names, target.targetName())
+	}
+	return names
+}
+
 // RegisterPushExport adds a push export connection to the Exporter.  Items in
 // the list must describe a Dial()able connection and will have all the metrics
-// pushed to each pushInterval.
+// pushed to each pushInterval.  If retries are enabled, failed pushes to
+// targets that don't reply to each line are queued and retried.  Only targets
+// that record the timestamp of each point are retried: a target like statsd
+// that applies each line on arrival would count a replayed counter increment
+// twice.
 func (e *Exporter) RegisterPushExport(p pushOptions) {
+	if *retryQueueBytes > 0 && p.reply == nil && p.timestamps {
+		shards := p.conns
+		if shards < 1 {
+			shards = 1
+		}
+		for i := 0; i < shards; i++ {
+			p.queues = append(p.queues, newRetryQueue(p.name, *retryQueueBytes))
+		}
+	}
 	e.pushTargets = append(e.pushTargets, p)
 }
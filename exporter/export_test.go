@@ -4,10 +4,19 @@
 package exporter
 
 import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/mtail/metrics"
@@ -123,6 +132,52 @@ func TestMetricToGraphite(t *testing.T) {
 	}
 }
 
+func TestMetricToGraphiteHostPosition(t *testing.T) {
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	*graphitePrefix = ""
+
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 37, time.Unix(1343124840, 0))
+	for position, expected := range map[string]string{
+		graphiteHostNone:   "prog.foo 37 1343124840\n",
+		graphiteHostPrefix: "gunstar.prog.foo 37 1343124840\n",
+		graphiteHostSuffix: "prog.foo.gunstar 37 1343124840\n",
+	} {
+		r := FakeSocketWrite(graphiteFormatter(position), m)
+		if diff := cmp.Diff([]string{expected}, r); diff != "" {
+			t.Errorf("%s: string didn't match:\n%s", position, diff)
+		}
+	}
+}
+
+func TestNewGraphiteTargets(t *testing.T) {
+	defer func(s string) { *graphiteHostPort = s }(*graphiteHostPort)
+	defer func(s string) { *graphiteHostPosition = s }(*graphiteHostPosition)
+	*graphiteHostPort = "old:2003,new:2003"
+	*graphiteHostPosition = "prefix,suffix"
+
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	var names []string
+	for _, target := range e.pushTargets {
+		names = append(names, target.name+" "+target.familyName())
+	}
+	expected := []string{"graphite@old:2003 graphite", "graphite@new:2003 graphite"}
+	if diff := cmp.Diff(expected, names); diff != "" {
+		t.Errorf("targets didn't match:\n%s", diff)
+	}
+
+	for _, positions := range []string{"prefix,suffix,none", "middle"} {
+		*graphiteHostPosition = positions
+		if _, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"}); err == nil {
+			t.Errorf("%q: expected error", positions)
+		}
+	}
+}
+
 func TestMetricToStatsd(t *testing.T) {
 	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
 	if terr != nil {
@@ -166,4 +221,896 @@ func TestMetricToStatsd(t *testing.T) {
 	if !reflect.DeepEqual(expected, r) {
 		t.Errorf("prefixed string didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
+	*statsdPrefix = ""
+}
+
+func TestMetricToStatsdGauge(t *testing.T) {
+	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
+	if terr != nil {
+		t.Errorf("time parse error: %s", terr)
+	}
+	for _, tc := range []struct {
+		d        datum.Datum
+		expected string
+	}{
+		{datum.MakeInt(37, ts), "prog.foo:37|g"},
+		{datum.MakeInt(0, ts), "prog.foo:0|g"},
+		{datum.MakeInt(-37, ts), "prog.foo:0|g\nprog.foo:-37|g"},
+		{datum.MakeFloat(1.5, ts), "prog.foo:1.5|g"},
+		{datum.MakeFloat(-1.5, ts), "prog.foo:0|g\nprog.foo:-1.5|g"},
+	} {
+		m := &metrics.Metric{
+			Name:        "foo",
+			Program:     "prog",
+			Kind:        metrics.Gauge,
+			LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: tc.d}},
+		}
+		r := FakeSocketWrite(metricToStatsd, m)
+		if diff := cmp.Diff([]string{tc.expected}, r); diff != "" {
+			t.Errorf("String didn't match for %s:\n%s", tc.d.ValueString(), diff)
+		}
+	}
+
+	// Negative counters aren't relative, so they are sent unchanged.
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, -37, ts)
+	r := FakeSocketWrite(metricToStatsd, m)
+	if diff := cmp.Diff([]string{"prog.foo:-37|c"}, r); diff != "" {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+}
+
+// replyConn is a fake push connection that records written lines and serves
+// canned replies.
+type replyConn struct {
+	replies io.Reader
+	written bytes.Buffer
+}
+
+func (c *replyConn) Read(b []byte) (int, error)  { return c.replies.Read(b) }
+func (c *replyConn) Write(b []byte) (int, error) { return c.written.Write(b) }
+
+func TestWriteSocketMetricsRejected(t *testing.T) {
+	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
+	if terr != nil {
+		t.Errorf("time parse error: %s", terr)
+	}
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Int, "label")
+	d, _ := m.GetDatum("quux")
+	datum.SetInt(d, 37, ts)
+	d, _ = m.GetDatum("snuh")
+	datum.SetInt(d, 37, ts)
+	ms.Add(m)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	dl := &bytes.Buffer{}
+	e.deadLetter = dl
+	*collectdPrefix = ""
+
+	c := &replyConn{replies: strings.NewReader("0 Success: 1 value has been dispatched.\n-1 Unknown type.\n")}
+	target := pushOptions{
+		net:     "unix",
+		addr:    "collectd",
+		f:       metricToCollectd,
+		reply:   readCollectdReply,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	n, err := e.writeSocketMetrics(c, target)
+	if err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("success count: expected 1, received %d", n)
+	}
+	fields := strings.Split(strings.TrimSpace(dl.String()), "\t")
+	if len(fields) != 4 {
+		t.Fatalf("unexpected dead letter entry %q", dl.String())
+	}
+	expected := []string{"collectd", "Unknown type.", `PUTVAL "gunstar/mtail-prog/gauge-bar-label-snuh" interval=60 1343124840:37`}
+	if diff := cmp.Diff(expected, fields[1:]); diff != "" {
+		t.Errorf("dead letter didn't match:\n%s", diff)
+	}
+}
+
+func TestWriteSocketMetricsTransportError(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	c := &replyConn{replies: strings.NewReader("")}
+	target := pushOptions{
+		net:     "unix",
+		addr:    "collectd",
+		f:       metricToCollectd,
+		reply:   readCollectdReply,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	if _, err := e.writeSocketMetrics(c, target); err == nil {
+		t.Errorf("expected error from closed reply stream")
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	defer func(max int) { *maxNameBytes = max }(*maxNameBytes)
+
+	*maxNameBytes = 0
+	long := strings.Repeat("a", 300)
+	if r := truncateName(long); r != long {
+		t.Errorf("expected no truncation with no limit, received %q", r)
+	}
+
+	*maxNameBytes = 20
+	for _, name := range []string{"prog.foo", "prog.exactly_20_bytes"[:20]} {
+		if r := truncateName(name); r != name {
+			t.Errorf("expected %q unchanged, received %q", name, r)
+		}
+	}
+
+	before := exportNamesTruncated.Value()
+	a := truncateName("prog.request_latency.handler.aaaa")
+	b := truncateName("prog.request_latency.handler.bbbb")
+	if n := exportNamesTruncated.Value() - before; n != 2 {
+		t.Errorf("expected 2 truncations counted, received %d", n)
+	}
+	if len(a) != 20 || len(b) != 20 {
+		t.Errorf("expected names truncated to 20 bytes, received %q and %q", a, b)
+	}
+	if !strings.HasPrefix(a, "prog.reques") {
+		t.Errorf("expected truncated name to keep its prefix, received %q", a)
+	}
+	if a == b {
+		t.Errorf("truncated names collide: %q", a)
+	}
+	if r := truncateName("prog.request_latency.handler.aaaa"); r != a {
+		t.Errorf("truncation not stable: %q != %q", r, a)
+	}
+
+	// Multibyte characters aren't split.
+	r := truncateName("prog.ééééééééééééé")
+	if !utf8.ValidString(r) || len(r) > 20 {
+		t.Errorf("expected valid string no longer than 20 bytes, received %q", r)
+	}
+
+	*maxNameBytes = 4
+	if r := truncateName("prog.foo"); len(r) != 4 {
+		t.Errorf("expected name truncated to 4 bytes, received %q", r)
+	}
+}
+
+func TestWriteSocketMetricsMaxBackfill(t *testing.T) {
+	defer func(d time.Duration) { *maxBackfill = d }(*maxBackfill)
+	*graphitePrefix = ""
+
+	now := time.Now().UTC().Truncate(time.Second)
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Int, "age")
+	d, _ := m.GetDatum("new")
+	datum.SetInt(d, 1, now.Add(-time.Minute))
+	d, _ = m.GetDatum("old")
+	datum.SetInt(d, 2, now.Add(-48*time.Hour))
+	ms.Add(m)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	for _, tc := range []struct {
+		maxBackfill time.Duration
+		timestamps  bool
+		expected    int
+	}{
+		{0, true, 2},
+		{24 * time.Hour, true, 1},
+		{24 * time.Hour, false, 2},
+	} {
+		*maxBackfill = tc.maxBackfill
+		target := pushOptions{
+			name:       "graphite",
+			f:          metricToGraphite,
+			timestamps: tc.timestamps,
+			total:      new(expvar.Int),
+			success:    new(expvar.Int),
+		}
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		if len(lines) != tc.expected {
+			t.Errorf("max backfill %s timestamps %v: expected %d lines, received %q", tc.maxBackfill, tc.timestamps, tc.expected, lines)
+		}
+	}
+}
+
+func TestPushShardedMetrics(t *testing.T) {
+	*graphitePrefix = ""
+	ms := metrics.NewStore()
+	for i := 0; i < 20; i++ {
+		m := metrics.NewMetric(fmt.Sprintf("foo%d", i), "prog", metrics.Counter, metrics.Int)
+		m.GetDatum()
+		ms.Add(m)
+	}
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+	lines := make(chan string)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				s := bufio.NewScanner(c)
+				for s.Scan() {
+					lines <- s.Text()
+				}
+			}()
+		}
+	}()
+
+	target := pushOptions{
+		name:    "graphite",
+		net:     "tcp",
+		addr:    l.Addr().String(),
+		f:       metricToGraphite,
+		conns:   3,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	if err := e.pushTo(target); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		seen[strings.Fields(<-lines)[0]] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("expected 20 distinct metrics, received %d: %v", len(seen), seen)
+	}
+	if target.success.Value() != 20 {
+		t.Errorf("success count: expected 20, received %d", target.success.Value())
+	}
+}
+
+func TestWriteSocketMetricsKindOrder(t *testing.T) {
+	defer func(o string) { *kindOrder = o }(*kindOrder)
+	*graphitePrefix = ""
+
+	ms := metrics.NewStore()
+	for _, m := range []*metrics.Metric{
+		metrics.NewMetric("a_counter", "prog", metrics.Counter, metrics.Int),
+		metrics.NewMetric("b_gauge", "prog", metrics.Gauge, metrics.Int),
+		metrics.NewMetric("c_timer", "prog", metrics.Timer, metrics.Int),
+		metrics.NewMetric("d_gauge", "prog", metrics.Gauge, metrics.Int),
+	} {
+		m.GetDatum()
+		ms.Add(m)
+	}
+	for _, tc := range []struct {
+		order    string
+		expected []string
+	}{
+		{"", []string{"a_counter", "b_gauge", "c_timer", "d_gauge"}},
+		{"gauge,counter", []string{"b_gauge", "d_gauge", "a_counter", "c_timer"}},
+		{"Timer, gauge", []string{"c_timer", "b_gauge", "d_gauge", "a_counter"}},
+	} {
+		*kindOrder = tc.order
+		e, err := New(Options{Store: ms, Hostname: "gunstar"})
+		if err != nil {
+			t.Fatalf("couldn't make exporter: %s", err)
+		}
+		target := pushOptions{
+			name:    "graphite",
+			f:       metricToGraphite,
+			total:   new(expvar.Int),
+			success: new(expvar.Int),
+		}
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+			names = append(names, strings.TrimPrefix(strings.Fields(line)[0], "prog."))
+		}
+		if diff := cmp.Diff(tc.expected, names); diff != "" {
+			t.Errorf("order %q didn't match:\n%s", tc.order, diff)
+		}
+	}
+
+	for _, order := range []string{"gauge,histogram", "gauge,gauge"} {
+		*kindOrder = order
+		if _, err := New(Options{Store: ms}); err == nil {
+			t.Errorf("expected error for kind order %q", order)
+		}
+	}
+}
+
+func TestPushMetricsExportEvery(t *testing.T) {
+	*graphitePrefix = ""
+	ms := metrics.NewStore()
+	fast := metrics.NewMetric("fast", "prog", metrics.Counter, metrics.Int)
+	fast.GetDatum()
+	ms.Add(fast)
+	slow := metrics.NewMetric("slow", "prog", metrics.Counter, metrics.Int)
+	slow.ExportEvery = 3
+	slow.GetDatum()
+	ms.Add(slow)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "graphite",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	var pushed []int
+	for i := 0; i < 7; i++ {
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+		pushed = append(pushed, strings.Count(b.String(), "prog."))
+		e.PushMetrics()
+	}
+	if diff := cmp.Diff([]int{2, 1, 1, 2, 1, 1, 2}, pushed); diff != "" {
+		t.Errorf("lines pushed on each cycle didn't match:\n%s", diff)
+	}
+}
+
+func TestMetricToGraphiteNameTransforms(t *testing.T) {
+	defer func(s string) { *graphiteNameTransforms = s }(*graphiteNameTransforms)
+	*graphitePrefix = ""
+	*graphiteNameTransforms = "lowercase,strip_prefix:app_"
+	ms := metrics.NewStore()
+	if _, err := New(Options{Store: ms, Hostname: "gunstar"}); err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	defer func() { graphiteNameTransform = nil }()
+
+	ts := time.Unix(1343124840, 0)
+	m := metrics.NewMetric("App_Requests", "prog", metrics.Counter, metrics.Int, "Code")
+	d, _ := m.GetDatum("200")
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(metricToGraphite, m)
+	expected := []string{"prog.requests.Code.200 37 1343124840\n"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	*graphiteNameTransforms = "uppercase"
+	if _, err := New(Options{Store: ms, Hostname: "gunstar"}); err == nil {
+		t.Errorf("expected error for unknown transform")
+	}
+}
+
+func TestWriteSocketMetricsMinCount(t *testing.T) {
+	*graphitePrefix = ""
+
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	d, _ := c.GetDatum("200")
+	datum.SetInt(d, 5, time.Unix(1343124840, 0))
+	d, _ = c.GetDatum("500")
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(c)
+	g := metrics.NewMetric("queue", "prog", metrics.Gauge, metrics.Int)
+	d, _ = g.GetDatum()
+	datum.SetInt(d, 0, time.Unix(1343124840, 0))
+	ms.Add(g)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:     "mincount",
+		f:        metricToGraphite,
+		minCount: 2,
+		total:    new(expvar.Int),
+		success:  new(expvar.Int),
+	}
+	b := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(b, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	expected := "prog.queue 0 1343124840\nprog.requests.code.200 5 1343124840\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if r := exportMinCountSkipped.Get("mincount").String(); r != "1" {
+		t.Errorf("expected 1 series skipped, received %s", r)
+	}
+
+	// Another target without a minimum count gets every series.
+	other := pushOptions{
+		name:    "nomincount",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	b.Reset()
+	if _, err := e.writeSocketMetrics(b, other); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	expected = "prog.queue 0 1343124840\nprog.requests.code.200 5 1343124840\nprog.requests.code.500 1 1343124840\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
+
+func TestNewMinCountTargets(t *testing.T) {
+	defer func(c float64) { *minCount = c }(*minCount)
+	defer func(s string) { *graphiteHostPort = s }(*graphiteHostPort)
+	defer func(s string) { *fifoExportPath = s }(*fifoExportPath)
+	*minCount = 2
+	*graphiteHostPort = "localhost:2003"
+	*fifoExportPath = "/tmp/mtail.fifo"
+
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	for _, target := range e.pushTargets {
+		expected := 0.0
+		if target.name == "graphite" {
+			expected = 2
+		}
+		if target.minCount != expected {
+			t.Errorf("%s: expected min count %v, received %v", target.name, expected, target.minCount)
+		}
+	}
+}
+
+func TestMetricToGraphiteFloatFormat(t *testing.T) {
+	defer func(s string) { *graphiteFloatFormat = s }(*graphiteFloatFormat)
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	*graphitePrefix = ""
+
+	ts := time.Unix(1343124840, 0)
+	tests := []struct {
+		value      float64
+		fixed, sci string
+	}{
+		{1e21, "1000000000000000000000", "1e+21"},
+		{1.5e300, "15" + strings.Repeat("0", 299), "1.5e+300"},
+		{-12345678901234567890, "-12345678901234567000", "-1.2345678901234567e+19"},
+		{1e-7, "0.0000001", "1e-07"},
+		{2.5e-10, "0.00000000025", "2.5e-10"},
+		{21.5, "21.5", "21.5"},
+	}
+	for _, tc := range tests {
+		m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Float)
+		d, _ := m.GetDatum()
+		datum.SetFloat(d, tc.value, ts)
+
+		*graphiteFloatFormat = "f"
+		r := FakeSocketWrite(metricToGraphite, m)
+		if diff := cmp.Diff([]string{"prog.foo " + tc.fixed + " 1343124840\n"}, r); diff != "" {
+			t.Errorf("%g: fixed point didn't match:\n%s", tc.value, diff)
+		}
+		if strings.ContainsAny(r[0], "eE") {
+			t.Errorf("%g: scientific notation in %q", tc.value, r[0])
+		}
+
+		*graphiteFloatFormat = "g"
+		r = FakeSocketWrite(metricToGraphite, m)
+		if diff := cmp.Diff([]string{"prog.foo " + tc.sci + " 1343124840\n"}, r); diff != "" {
+			t.Errorf("%g: g format didn't match:\n%s", tc.value, diff)
+		}
+	}
+}
+
+func TestMetricToFIFOIgnoresGraphiteFlags(t *testing.T) {
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	defer func(s string) { *graphiteDecimalSeparator = s }(*graphiteDecimalSeparator)
+	defer func(s string) { *graphiteFloatFormat = s }(*graphiteFloatFormat)
+	defer func() { graphiteNameTransform = nil }()
+	*graphitePrefix = "legacy."
+	*graphiteDecimalSeparator = ","
+	*graphiteFloatFormat = "g"
+	graphiteNameTransform = strings.ToUpper
+
+	m := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float, "room")
+	d, _ := m.GetDatum("kitchen")
+	datum.SetFloat(d, 2.5e21, time.Unix(1343124840, 0))
+	expected := []string{"prog.temperature.room.kitchen 2500000000000000000000 1343124840\n"}
+	if diff := cmp.Diff(expected, FakeSocketWrite(metricToFIFO, m)); diff != "" {
+		t.Errorf("fifo line didn't match:\n%s", diff)
+	}
+	datum.SetFloat(d, 21.5, time.Unix(1343124840, 0))
+	expected = []string{"prog.temperature.room.kitchen 21.5 1343124840\n"}
+	if diff := cmp.Diff(expected, FakeSocketWrite(metricToFIFO, m)); diff != "" {
+		t.Errorf("fifo line didn't match:\n%s", diff)
+	}
+}
+
+func TestMetricToGraphiteDecimalSeparator(t *testing.T) {
+	defer func(s string) { *graphiteDecimalSeparator = s }(*graphiteDecimalSeparator)
+	*graphitePrefix = ""
+	*graphiteDecimalSeparator = ","
+
+	ts := time.Unix(1343124840, 0)
+	m := metrics.NewMetric("temperature", "prog", metrics.Gauge, metrics.Float, "room")
+	d, _ := m.GetDatum("kitchen.1")
+	datum.SetFloat(d, 21.5, ts)
+	r := FakeSocketWrite(metricToGraphite, m)
+	expected := []string{"prog.temperature.room.kitchen_1 21,5 1343124840\n"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	// Other targets are not affected.
+	*statsdPrefix = ""
+	r = FakeSocketWrite(metricToStatsd, m)
+	expected = []string{"prog.temperature.room.kitchen_1:21.5|g"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+}
+
+func TestPushMetricsHeartbeat(t *testing.T) {
+	ms := metrics.NewStore()
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	if _, ok := ms.Metrics[heartbeatName]; ok {
+		t.Errorf("heartbeat added to store before first push")
+	}
+	for i := 0; i < 3; i++ {
+		e.PushMetrics()
+	}
+	ml := ms.Metrics[heartbeatName]
+	if len(ml) != 1 {
+		t.Fatalf("expected one heartbeat metric, received %v", ml)
+	}
+	d, _ := ml[0].GetDatum()
+	if r := d.ValueString(); r != "3" {
+		t.Errorf("expected heartbeat of 3, received %s", r)
+	}
+}
+
+func TestPushOptionsTimeouts(t *testing.T) {
+	defer func(d time.Duration) { *writeDeadline = d }(*writeDeadline)
+	*writeDeadline = 10 * time.Second
+
+	p := pushOptions{}
+	if p.dialTimeout() != 10*time.Second || p.writeDeadline() != 10*time.Second {
+		t.Errorf("expected fallback to global deadline, received %s and %s", p.dialTimeout(), p.writeDeadline())
+	}
+	p = pushOptions{dial: time.Minute, deadline: time.Second}
+	if p.dialTimeout() != time.Minute || p.writeDeadline() != time.Second {
+		t.Errorf("expected per-target timeouts, received %s and %s", p.dialTimeout(), p.writeDeadline())
+	}
+}
+
+func TestPushMetricsResetAfterExport(t *testing.T) {
+	ms := metrics.NewStore()
+	g := metrics.NewMetric("last_size", "prog", metrics.Gauge, metrics.Int, "handler")
+	g.ResetAfterExport = true
+	g.GetDatum("a")
+	ms.Add(g)
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int)
+	c.GetDatum()
+	ms.Add(c)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.PushMetrics()
+	if len(g.LabelValues) != 0 {
+		t.Errorf("expected gauge reset after push, received %v", g.LabelValues)
+	}
+	if len(c.LabelValues) != 1 {
+		t.Errorf("expected counter not reset after push, received %v", c.LabelValues)
+	}
+}
+
+func TestPushMetricsResetAfterFailedPush(t *testing.T) {
+	ms := metrics.NewStore()
+	g := metrics.NewMetric("last_size", "prog", metrics.Gauge, metrics.Int, "handler")
+	g.ResetAfterExport = true
+	g.GetDatum("a")
+	ms.Add(g)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	// Nothing listens on the address once the listener is closed, so every
+	// push fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	e.RegisterPushExport(pushOptions{
+		name:    "failing",
+		net:     "tcp",
+		addr:    addr,
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	})
+	e.PushMetrics()
+	if len(g.LabelValues) != 1 {
+		t.Errorf("expected gauge kept after failed push, received %v", g.LabelValues)
+	}
+}
+
+func TestPushTimeJitter(t *testing.T) {
+	defer func(d time.Duration) { *timestampJitter = d }(*timestampJitter)
+	ts := time.Unix(1343124840, 0).UTC()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, ts)
+	l := &metrics.LabelSet{Labels: map[string]string{}, Datum: d}
+
+	*timestampJitter = 0
+	if r := pushTimeString("gunstar", l); r != "1343124840" {
+		t.Errorf("expected unjittered timestamp, received %s", r)
+	}
+
+	*timestampJitter = 10 * time.Second
+	hosts := map[time.Time]bool{}
+	for _, host := range []string{"gunstar", "grand", "zarniwoop", "slartibartfast"} {
+		r := pushTime(host, l)
+		if r.After(ts) || !r.After(ts.Add(-*timestampJitter)) {
+			t.Errorf("%s: jittered time %s not within %s before %s", host, r, *timestampJitter, ts)
+		}
+		if r2 := pushTime(host, l); r2 != r {
+			t.Errorf("%s: jitter not stable: %s != %s", host, r, r2)
+		}
+		hosts[r] = true
+	}
+	if len(hosts) < 2 {
+		t.Errorf("expected hosts to be spread across the jitter window, received %v", hosts)
+	}
+
+	*timestampJitter = time.Duration(*pushInterval) * time.Second
+	if _, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"}); err == nil {
+		t.Errorf("expected error for jitter as long as the push interval")
+	}
+}
+
+func TestWriteSocketMetricsSampleRate(t *testing.T) {
+	*graphitePrefix = ""
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	for i := 0; i < 1000; i++ {
+		d, _ := c.GetDatum(fmt.Sprintf("%d", i))
+		datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	}
+	ms.Add(c)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:       "sampled",
+		f:          metricToGraphite,
+		sampleRate: 0.1,
+		total:      new(expvar.Int),
+		success:    new(expvar.Int),
+	}
+	first := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(first, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	n := strings.Count(first.String(), "\n")
+	if n < 50 || n > 150 {
+		t.Errorf("expected about 100 of 1000 series sampled, received %d", n)
+	}
+	// The same series are chosen on every push.
+	second := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(second, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	if diff := cmp.Diff(sortedLines(first.String()), sortedLines(second.String())); diff != "" {
+		t.Errorf("sampled series changed between pushes:\n%s", diff)
+	}
+}
+
+func sortedLines(s string) []string {
+	lines := strings.Split(s, "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestMetricToStatsdExplodeLabel(t *testing.T) {
+	defer func(s string) { *statsdExplodeLabel = s }(*statsdExplodeLabel)
+	*statsdExplodeLabel = "code"
+	ts := time.Unix(1343124840, 0)
+
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	d, _ := m.GetDatum("200")
+	datum.SetInt(d, 37, ts)
+	d, _ = m.GetDatum("404")
+	datum.SetInt(d, 2, ts)
+	r := FakeSocketWrite(metricToStatsd, m)
+	expected := []string{"prog.requests_200:37|c", "prog.requests_404:2|c"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("exploded metric didn't match:\n%s", diff)
+	}
+
+	m = metrics.NewMetric("bytes", "prog", metrics.Counter, metrics.Int, "method", "code")
+	d, _ = m.GetDatum("GET", "1.1")
+	datum.SetInt(d, 10, ts)
+	r = FakeSocketWrite(metricToStatsd, m)
+	expected = []string{"prog.bytes_1_1.method.GET:10|c"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("exploded metric didn't match:\n%s", diff)
+	}
+
+	m = metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Int, "l")
+	d, _ = m.GetDatum("quux")
+	datum.SetInt(d, 1, ts)
+	r = FakeSocketWrite(metricToStatsd, m)
+	expected = []string{"prog.bar.l.quux:1|g"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("metric without the label didn't match:\n%s", diff)
+	}
+}
+
+func TestPushMetricsPublicOnly(t *testing.T) {
+	defer func(b bool) { *publicOnly = b }(*publicOnly)
+	*publicOnly = true
+	*graphitePrefix = ""
+
+	ms := metrics.NewStore()
+	pub := metrics.NewMetric("public", "prog", metrics.Counter, metrics.Int)
+	pub.Public = true
+	d, _ := pub.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(pub)
+	priv := metrics.NewMetric("private", "prog", metrics.Counter, metrics.Int)
+	d, _ = priv.GetDatum()
+	datum.SetInt(d, 2, time.Unix(1343124840, 0))
+	ms.Add(priv)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "public",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	b := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(b, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	if diff := cmp.Diff("prog.public 1 1343124840\n", b.String()); diff != "" {
+		t.Errorf("pushed lines didn't match:\n%s", diff)
+	}
+}
+
+func TestWriteSocketMetricsExportTo(t *testing.T) {
+	*graphitePrefix = ""
+	ms := metrics.NewStore()
+	for _, tc := range []struct {
+		name     string
+		exportTo []string
+	}{
+		{"everywhere", nil},
+		{"graphite_only", []string{"graphite"}},
+		{"statsd_only", []string{"statsd", "prometheus"}},
+	} {
+		m := metrics.NewMetric(tc.name, "prog", metrics.Counter, metrics.Int)
+		m.ExportTo = tc.exportTo
+		d, _ := m.GetDatum()
+		datum.SetInt(d, 1, time.Unix(1343124840, 0))
+		ms.Add(m)
+	}
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "graphite",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	b := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(b, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	expected := "prog.everywhere 1 1343124840\nprog.graphite_only 1 1343124840\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("pushed lines didn't match:\n%s", diff)
+	}
+}
+
+func TestPushToAlignTimestamps(t *testing.T) {
+	defer func(d time.Duration) { *timestampJitter = d }(*timestampJitter)
+	*graphitePrefix = ""
+	// Aligned timestamps aren't moved into the previous interval by jitter.
+	for _, jitter := range []time.Duration{0, 10 * time.Second} {
+		*timestampJitter = jitter
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("couldn't listen: %s", err)
+		}
+		received := make(chan string, 1)
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var lines []string
+			s := bufio.NewScanner(c)
+			for s.Scan() {
+				lines = append(lines, s.Text())
+			}
+			received <- strings.Join(lines, "\n")
+		}()
+
+		ms := metrics.NewStore()
+		for i, name := range []string{"a", "b"} {
+			m := metrics.NewMetric(name, "prog", metrics.Counter, metrics.Int)
+			d, _ := m.GetDatum()
+			datum.SetInt(d, 1, time.Now().Add(-time.Duration(i*17)*time.Second))
+			ms.Add(m)
+		}
+		e, err := New(Options{Store: ms, Hostname: "gunstar"})
+		if err != nil {
+			t.Fatalf("couldn't make exporter: %s", err)
+		}
+		if jitter > 0 && jitterOffset("gunstar") == 0 {
+			t.Fatalf("expected a jitter offset for the test host")
+		}
+		target := pushOptions{
+			name:       "align",
+			net:        "tcp",
+			addr:       l.Addr().String(),
+			f:          metricToGraphite,
+			timestamps: true,
+			align:      true,
+			total:      new(expvar.Int),
+			success:    new(expvar.Int),
+		}
+		start := time.Now().Truncate(time.Duration(*pushInterval) * time.Second).Unix()
+		if err := e.pushTo(target); err != nil {
+			t.Fatalf("jitter %s: push failed: %s", jitter, err)
+		}
+		for _, line := range strings.Split(<-received, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 3 {
+				t.Fatalf("bad line %q", line)
+			}
+			ts, _ := strconv.ParseInt(fields[2], 10, 64)
+			if ts%int64(*pushInterval) != 0 || ts < start {
+				t.Errorf("jitter %s: expected timestamp aligned to the push interval in %q", jitter, line)
+			}
+		}
+		l.Close()
+	}
 }
@@ -0,0 +1,63 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	fifoExportPath = flag.String("fifo_export_path", "",
+		"Path to a named pipe to write metrics to on each push, in the graphite text format.  The graphite_* flags don't apply to the pipe.  If nothing is reading from the pipe, the push is skipped.")
+
+	fifoExportTotal   = expvar.NewInt("fifo_export_total")
+	fifoExportSuccess = expvar.NewInt("fifo_export_success")
+)
+
+// openFIFO opens the named pipe at the target address for writing, without
+// blocking.  If no process has the pipe open for reading, an error is
+// returned so that the push is skipped.
+func openFIFO(target pushOptions) (io.WriteCloser, error) {
+	fi, err := os.Stat(target.addr)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return nil, errors.Errorf("%s is not a named pipe", target.addr)
+	}
+	f, err := os.OpenFile(target.addr, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			return nil, errors.Errorf("no reader on %s, skipping push", target.addr)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// metricToFIFO encodes a metric in the graphite text protocol format for the
+// named pipe.  None of the graphite_* flags apply, so settings meant for a
+// graphite server don't change what the reader of the pipe has to parse;
+// float values are always written in fixed point notation with a dot.  The
+// metric lock is held before entering this function.
+func metricToFIFO(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	value := pushValueString(l.Datum)
+	if l.Datum.Type() == datum.Float {
+		value = strconv.FormatFloat(pushValue(l.Datum), 'f', -1, 64)
+	}
+	return fmt.Sprintf("%s %s %s\n",
+		truncateName(m.Program+"."+formatLabels(m.Name, l.Labels, ".", ".", "_")),
+		value,
+		pushTimeString(hostname, l))
+}
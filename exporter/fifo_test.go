@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package exporter
+
+import (
+	"bufio"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/google/mtail/metrics"
+)
+
+func TestPushFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifo")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatalf("couldn't make fifo: %s", err)
+	}
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "fifo",
+		addr:    path,
+		f:       metricToFIFO,
+		open:    openFIFO,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+
+	// With no reader the push is skipped.
+	if err := e.pushTo(target); err == nil || !strings.Contains(err.Error(), "no reader") {
+		t.Errorf("expected no reader error, received %v", err)
+	}
+
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("couldn't open fifo for reading: %s", err)
+	}
+	defer r.Close()
+	if err := e.pushTo(target); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatalf("couldn't read from fifo: %s", err)
+	}
+	if !strings.HasPrefix(line, "prog.foo 0 ") {
+		t.Errorf("unexpected line %q", line)
+	}
+	if target.success.Value() != 1 {
+		t.Errorf("expected 1 success, received %d", target.success.Value())
+	}
+
+	// A regular file is not written to.
+	target.addr = filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(target.addr, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.pushTo(target); err == nil {
+		t.Errorf("expected error pushing to a regular file")
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	exportLabelFiltered = expvar.NewMap("metric_push_label_filtered_total")
+)
+
+// labelRequirement is a label and value that a series must have to be pushed
+// to a target.
+type labelRequirement struct {
+	key, value string
+}
+
+// parseLabelRequirement parses a requirement of the form key:value.  An empty
+// string returns nil, meaning all series are pushed.
+func parseLabelRequirement(s string) (*labelRequirement, error) {
+	if s == "" {
+		return nil, nil
+	}
+	i := strings.Index(s, ":")
+	if i < 1 {
+		return nil, errors.Errorf("label requirement %q is not of the form key:value", s)
+	}
+	return &labelRequirement{key: s[:i], value: s[i+1:]}, nil
+}
+
+// matches returns true if the series has the required label and value.
+func (r *labelRequirement) matches(l *metrics.LabelSet) bool {
+	v, ok := l.Labels[r.key]
+	return ok && v == r.value
+}
@@ -0,0 +1,68 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestParseLabelRequirement(t *testing.T) {
+	for _, s := range []string{"safe", ":true"} {
+		if _, err := parseLabelRequirement(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+	r, err := parseLabelRequirement("safe:true")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if diff := cmp.Diff(&labelRequirement{"safe", "true"}, r, cmp.AllowUnexported(labelRequirement{})); diff != "" {
+		t.Errorf("requirement didn't match:\n%s", diff)
+	}
+}
+
+func TestWriteSocketMetricsRequireLabel(t *testing.T) {
+	*graphitePrefix = ""
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int, "safe")
+	d, _ := m.GetDatum("true")
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	m.GetDatum("false")
+	ms.Add(m)
+	unlabelled := metrics.NewMetric("bar", "prog", metrics.Counter, metrics.Int)
+	unlabelled.GetDatum()
+	ms.Add(unlabelled)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "filtered",
+		f:       metricToGraphite,
+		require: &labelRequirement{"safe", "true"},
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	b := &bytes.Buffer{}
+	n, err := e.writeSocketMetrics(b, target)
+	if err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 line written, received %d", n)
+	}
+	if diff := cmp.Diff("prog.foo.safe.true 1 1343124840\n", b.String()); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if r := exportLabelFiltered.Get("filtered").String(); r != "2" {
+		t.Errorf("expected 2 series filtered, received %s", r)
+	}
+}
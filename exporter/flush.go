@@ -0,0 +1,101 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// flushPolicy describes how often a buffered push is flushed to the target:
+// after a number of series, or after an interval of time.
+type flushPolicy struct {
+	series   int
+	interval time.Duration
+}
+
+func (f *flushPolicy) String() string {
+	switch {
+	case f.series > 0:
+		return strconv.Itoa(f.series)
+	case f.interval > 0:
+		return f.interval.String()
+	}
+	return ""
+}
+
+func (f *flushPolicy) Set(value string) error {
+	*f = flushPolicy{}
+	if value == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		if n <= 0 {
+			return errors.Errorf("flush series count must be positive: %d", n)
+		}
+		f.series = n
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.Errorf("%q is neither a series count nor a duration", value)
+	}
+	if d <= 0 {
+		return errors.Errorf("flush interval must be positive: %s", d)
+	}
+	f.interval = d
+	return nil
+}
+
+func (f *flushPolicy) enabled() bool {
+	return f.series > 0 || f.interval > 0
+}
+
+var flushEvery flushPolicy
+
+func init() {
+	flag.Var(&flushEvery, "metric_push_flush_every", "If set, pushes to stream targets like graphite are buffered, and the buffer is flushed after this many series (e.g. 1000) or this much time (e.g. 500ms) as well as at the end of the push.  If not set, each series is written as it is formatted.")
+}
+
+// flushWriter buffers the lines written to a push target, and flushes them
+// according to a flushPolicy.
+type flushWriter struct {
+	w       *bufio.Writer
+	policy  flushPolicy
+	last    time.Time // Time of the last flush.
+	pending int       // Count of lines written since the last flush.
+}
+
+func newFlushWriter(w io.Writer, policy flushPolicy) *flushWriter {
+	return &flushWriter{w: bufio.NewWriter(w), policy: policy, last: time.Now()}
+}
+
+// Write buffers a single line, flushing the buffer if the policy requires it.
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	f.pending++
+	if (f.policy.series > 0 && f.pending >= f.policy.series) ||
+		(f.policy.interval > 0 && time.Since(f.last) >= f.policy.interval) {
+		err = f.Flush()
+	}
+	return n, err
+}
+
+// Flush writes any buffered lines to the target.
+func (f *flushWriter) Flush() error {
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	f.pending = 0
+	f.last = time.Now()
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFlushPolicySet(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected flushPolicy
+		ok       bool
+	}{
+		{"", flushPolicy{}, true},
+		{"1000", flushPolicy{series: 1000}, true},
+		{"500ms", flushPolicy{interval: 500 * time.Millisecond}, true},
+		{"0", flushPolicy{}, false},
+		{"-1s", flushPolicy{}, false},
+		{"often", flushPolicy{}, false},
+	} {
+		var f flushPolicy
+		err := f.Set(tc.value)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error state %v", tc.value, err)
+		}
+		if err == nil && f != tc.expected {
+			t.Errorf("%q: expected %+v, received %+v", tc.value, tc.expected, f)
+		}
+	}
+}
+
+func TestFlushWriterSeries(t *testing.T) {
+	b := &bytes.Buffer{}
+	f := newFlushWriter(b, flushPolicy{series: 3})
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(f, "line %d\n", i)
+		if i == 1 && b.Len() != 0 {
+			t.Errorf("expected nothing flushed after 2 lines, received %q", b.String())
+		}
+		if i == 2 && b.String() != "line 0\nline 1\nline 2\n" {
+			t.Errorf("expected 3 lines flushed, received %q", b.String())
+		}
+	}
+	if f.pending != 2 {
+		t.Errorf("expected 2 lines pending, received %d", f.pending)
+	}
+	if err := f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if f.pending != 0 || b.Len() != 35 {
+		t.Errorf("expected all lines flushed, received %q", b.String())
+	}
+}
+
+func TestFlushWriterInterval(t *testing.T) {
+	b := &bytes.Buffer{}
+	f := newFlushWriter(b, flushPolicy{interval: time.Hour})
+	fmt.Fprint(f, "line 0\n")
+	if b.Len() != 0 {
+		t.Errorf("expected nothing flushed, received %q", b.String())
+	}
+	f.last = time.Now().Add(-2 * time.Hour)
+	fmt.Fprint(f, "line 1\n")
+	if b.String() != "line 0\nline 1\n" {
+		t.Errorf("expected lines flushed after interval, received %q", b.String())
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+var timestampSeries = flag.Bool("metric_push_timestamp_series", false,
+	"If true, points pushed to collectd, graphite and statsd are timestamped with the time of the push, and each series is followed by a <name>_timestamp gauge holding the time it was last updated, in seconds since the epoch.")
+
+// point is one series of a metric to push.
+type point struct {
+	m *metrics.Metric
+	l *metrics.LabelSet
+}
+
+// timestampMetric returns the companion metric of m that holds the update
+// times of its series.
+func timestampMetric(m *metrics.Metric) *metrics.Metric {
+	return metrics.NewMetric(m.Name+"_timestamp", m.Program, metrics.Gauge, metrics.Int, m.Keys...)
+}
+
+// timestampPoints returns the points to push for a series of m: its value at
+// now, and the time it was last updated, as a series of its companion metric
+// ts, also at now.
+func timestampPoints(m, ts *metrics.Metric, l *metrics.LabelSet, now time.Time) []point {
+	return []point{
+		{m, retime(l, now)},
+		{ts, &metrics.LabelSet{Labels: l.Labels, Datum: datum.MakeInt(l.Datum.TimeUTC().Unix(), now)}},
+	}
+}
+
+// retime returns a copy of the LabelSet with its value at time t.
+func retime(l *metrics.LabelSet, t time.Time) *metrics.LabelSet {
+	var v datum.Datum
+	switch l.Datum.Type() {
+	case datum.Float:
+		v = datum.MakeFloat(datum.GetFloat(l.Datum), t)
+	default:
+		v = datum.MakeInt(datum.GetInt(l.Datum), t)
+	}
+	return &metrics.LabelSet{Labels: l.Labels, Datum: v}
+}
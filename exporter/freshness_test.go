@@ -0,0 +1,61 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestWriteSocketMetricsTimestampSeries(t *testing.T) {
+	defer func(b bool) { *timestampSeries = b }(*timestampSeries)
+	*timestampSeries = true
+	*graphitePrefix = ""
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Float, "l")
+	d, _ := m.GetDatum("a")
+	datum.SetFloat(d, 1.5, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:       "timestamps",
+		f:          metricToGraphite,
+		timestamps: true,
+		total:      new(expvar.Int),
+		success:    new(expvar.Int),
+	}
+	start := time.Now().Unix()
+	b := &bytes.Buffer{}
+	if n, err := e.writeSocketMetrics(b, target); err != nil || n != 2 {
+		t.Fatalf("writeSocketMetrics wrote %d lines: %v", n, err)
+	}
+	var received []string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("bad line %q", line)
+		}
+		pt, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || pt < start {
+			t.Errorf("expected point time of the push in %q", line)
+		}
+		received = append(received, fields[0]+" "+fields[1])
+	}
+	expected := []string{"prog.foo.l.a 1.5", "prog.foo_timestamp.l.a 1343124840"}
+	if diff := cmp.Diff(expected, received); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
@@ -7,27 +7,143 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
 )
 
 var (
 	graphiteHostPort = flag.String("graphite_host_port", "",
-		"Host:port to graphite carbon server to write metrics to.")
+		"Host:port to graphite carbon server to write metrics to.  To push to several servers, give a comma separated list.")
+	graphiteHostPosition = flag.String("graphite_host_position", graphiteHostNone,
+		"Where the hostname goes in the paths pushed to graphite: none, prefix (host.prog.metric) or suffix (prog.metric.host).  To push to several servers with different paths, give a comma separated list with one position for each address in graphite_host_port.")
 	graphitePrefix = flag.String("graphite_prefix", "",
 		"Prefix to use for graphite metrics.")
+	graphiteRequireLabel = flag.String("graphite_require_label", "",
+		"If set to a label and value, e.g. safe:true, only series with exactly that label and value are pushed to graphite.  Other series are skipped, and counted in metric_push_label_filtered_total.")
+	graphiteAlignTimestamps = flag.Bool("graphite_align_timestamps", false,
+		"If true, every point pushed to graphite is timestamped with the start of the push interval it is pushed in, instead of the time its series was last updated.")
+	graphiteDrainReplies = flag.Bool("graphite_drain_replies", false,
+		"If true, read the lines that the graphite server sends back during a push, such as the error replies of servers that accept the graphite or OpenTSDB telnet protocol, and count each as a series the server rejected.  Plain carbon servers don't reply.")
+	graphiteDialTimeout = flag.Duration("graphite_dial_timeout", 0,
+		"Time to wait to connect to graphite on each push.  If 0, metric_push_write_deadline is used.")
+	graphiteWriteDeadline = flag.Duration("graphite_write_deadline", 0,
+		"Time to wait for each push to graphite to be written once connected.  If 0, metric_push_write_deadline is used.")
+	graphiteParallelConns = flag.Int("graphite_parallel_conns", 1,
+		"Number of connections to open to the graphite server on each push.  Metrics are sharded between the connections by name, and written in parallel.")
+	graphiteSampleRate = flag.Float64("graphite_series_sample_rate", 1,
+		"Fraction of series pushed to graphite, between 0 and 1.  Series are chosen by a hash of their name and labels, so the same series are pushed on every push.")
+	graphiteDecimalSeparator = flag.String("graphite_decimal_separator", ".",
+		"Decimal separator used in the values of metrics pushed to graphite, for backends that expect a locale specific separator such as a comma.")
+	graphiteFloatFormat = flag.String("graphite_float_format", "f",
+		"Notation of float values pushed to graphite: f for fixed point, which never uses an exponent however large or small the value, or g for the shorter of fixed point and scientific notation, such as 1e+21.")
+	graphiteNameTransforms = flag.String("graphite_name_transforms", "",
+		"Comma separated list of transforms applied in order to metric names pushed to graphite.  Transforms are lowercase, dot_to_underscore, dash_to_underscore, strip_prefix:<prefix> and strip_suffix:<suffix>.")
+
+	// graphiteNameTransform is parsed from graphiteNameTransforms when the
+	// exporter is created.
+	graphiteNameTransform nameTransform
 
 	graphiteExportTotal   = expvar.NewInt("graphite_export_total")
 	graphiteExportSuccess = expvar.NewInt("graphite_export_success")
 )
 
-// metricToGraphite encodes a metric in the graphite text protocol format.  The
-// metric lock is held before entering this function.
+// Positions of the hostname in graphite paths.
+const (
+	graphiteHostNone   = "none"
+	graphiteHostPrefix = "prefix"
+	graphiteHostSuffix = "suffix"
+)
+
+// graphiteTarget is a graphite server to push to, and the position of the
+// hostname in the paths pushed to it.
+type graphiteTarget struct {
+	addr, position string
+}
+
+// parseGraphiteTargets pairs each address in a comma separated list with its
+// host position.  A single position applies to every address.
+func parseGraphiteTargets(hostports, positions string) ([]graphiteTarget, error) {
+	addrs := strings.Split(hostports, ",")
+	ps := strings.Split(positions, ",")
+	if len(ps) != 1 && len(ps) != len(addrs) {
+		return nil, errors.Errorf("graphite_host_position has %d positions for %d addresses in graphite_host_port", len(ps), len(addrs))
+	}
+	var targets []graphiteTarget
+	for i, addr := range addrs {
+		p := ps[0]
+		if len(ps) > 1 {
+			p = ps[i]
+		}
+		p = strings.TrimSpace(p)
+		switch p {
+		case graphiteHostNone, graphiteHostPrefix, graphiteHostSuffix:
+		default:
+			return nil, errors.Errorf("unknown graphite_host_position %q, expected none, prefix or suffix", p)
+		}
+		targets = append(targets, graphiteTarget{strings.TrimSpace(addr), p})
+	}
+	return targets, nil
+}
+
+// metricToGraphite encodes a metric in the graphite text protocol format,
+// without the hostname in the path.  The metric lock is held before entering
+// this function.
 func metricToGraphite(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
-	return fmt.Sprintf("%s%s.%s %v %v\n",
-		*graphitePrefix,
-		m.Program,
-		formatLabels(m.Name, l.Labels, ".", ".", "_"),
-		l.Datum.ValueString(),
-		l.Datum.TimeString())
+	return graphiteLine(hostname, graphiteHostNone, m, l)
+}
+
+// graphiteFormatter returns a formatter that puts the hostname at position in
+// the path.
+func graphiteFormatter(position string) formatter {
+	if position == graphiteHostNone {
+		return metricToGraphite
+	}
+	return func(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+		return graphiteLine(hostname, position, m, l)
+	}
+}
+
+// graphiteLine encodes a metric in the graphite text protocol format, with
+// the hostname at position in the path.  Dots in the hostname are replaced
+// with underscores so it is a single node of the path.
+func graphiteLine(hostname, position string, m *metrics.Metric, l *metrics.LabelSet) string {
+	name := m.Name
+	if graphiteNameTransform != nil {
+		name = graphiteNameTransform(name)
+	}
+	path := m.Program + "." + formatLabels(name, l.Labels, ".", ".", "_")
+	host := strings.Replace(hostname, ".", "_", -1)
+	switch position {
+	case graphiteHostPrefix:
+		path = host + "." + path
+	case graphiteHostSuffix:
+		path = path + "." + host
+	}
+	path = truncateName(*graphitePrefix + path)
+	value := graphiteValueString(l.Datum)
+	if *graphiteDecimalSeparator != "." {
+		value = strings.Replace(value, ".", *graphiteDecimalSeparator, 1)
+	}
+	return fmt.Sprintf("%s %v %v\n",
+		path,
+		value,
+		pushTimeString(hostname, l))
+}
+
+// graphiteValueString returns the value of a Datum to push to graphite.
+// Float values are written in the notation set by graphite_float_format,
+// after any rounding, as some versions of graphite reject scientific notation.
+func graphiteValueString(d datum.Datum) string {
+	if d.Type() != datum.Float {
+		return pushValueString(d)
+	}
+	format := byte('f')
+	if *graphiteFloatFormat == "g" {
+		format = 'g'
+	}
+	return strconv.FormatFloat(pushValue(d), format, -1, 64)
 }
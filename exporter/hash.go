@@ -0,0 +1,124 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+var (
+	hashLabels = flag.String("metric_push_hash_label", "",
+		"Comma separated list of label:buckets, e.g. user_id:256.  When pushing to collectd, graphite and statsd, the values of each listed label are replaced by a hash of the value into one of that many buckets, named bucket0 to bucketN-1, and series in the same bucket are summed.  This is lossy and can't be reversed.")
+)
+
+// parseHashLabels parses a comma separated list of label:buckets into the
+// number of buckets for each label.
+func parseHashLabels(spec string) (map[string]uint32, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	r := make(map[string]uint32)
+	for _, item := range strings.Split(spec, ",") {
+		i := strings.LastIndex(item, ":")
+		if i < 1 {
+			return nil, errors.Errorf("label hash %q is not of the form label:buckets", item)
+		}
+		n, err := strconv.ParseUint(item[i+1:], 10, 32)
+		if err != nil || n == 0 {
+			return nil, errors.Errorf("label hash %q needs a positive number of buckets", item)
+		}
+		r[item[:i]] = uint32(n)
+	}
+	return r, nil
+}
+
+// hashBucket returns the name of the bucket that a label value hashes to.
+func hashBucket(value string, buckets uint32) string {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("bucket%d", h.Sum32()%buckets)
+}
+
+// hashesLabels reports whether any of the keys of the metric are hashed.
+func (e *Exporter) hashesLabels(m *metrics.Metric) bool {
+	for _, k := range m.Keys {
+		if _, ok := e.hashLabels[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketLabelSets reads the LabelSets of a metric from lc, replaces the values
+// of hashed labels with their buckets, and sums the LabelSets that end up
+// with the same labels.  Labels that aren't hashed, including the constant
+// labels, are kept.  The summed LabelSets are sent on the returned
+// channel, in order of their labels, and have the time of the latest update
+// in their bucket.
+func (e *Exporter) bucketLabelSets(m *metrics.Metric, lc <-chan *metrics.LabelSet) <-chan *metrics.LabelSet {
+	type bucket struct {
+		labels map[string]string
+		sum    float64
+		time   time.Time
+	}
+	buckets := make(map[string]*bucket)
+	for l := range lc {
+		labels := make(map[string]string, len(l.Labels))
+		for k, v := range l.Labels {
+			labels[k] = v
+		}
+		for _, k := range m.Keys {
+			if n, ok := e.hashLabels[k]; ok {
+				labels[k] = hashBucket(l.Labels[k], n)
+			}
+		}
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		values := make([]string, 0, 2*len(keys))
+		for _, k := range keys {
+			values = append(values, k, labels[k])
+		}
+		key := strings.Join(values, "\x00")
+		b, ok := buckets[key]
+		if !ok {
+			b = &bucket{labels: labels}
+			buckets[key] = b
+		}
+		b.sum += datumValue(l.Datum)
+		if t := l.Datum.TimeUTC(); t.After(b.time) {
+			b.time = t
+		}
+	}
+	keys := make([]string, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	c := make(chan *metrics.LabelSet, len(keys))
+	for _, k := range keys {
+		b := buckets[k]
+		var d datum.Datum
+		if m.Type == datum.Float {
+			d = datum.MakeFloat(b.sum, b.time)
+		} else {
+			d = datum.MakeInt(int64(b.sum), b.time)
+		}
+		c <- &metrics.LabelSet{Labels: b.labels, Datum: d}
+	}
+	close(c)
+	return c
+}
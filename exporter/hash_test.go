@@ -0,0 +1,112 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestParseHashLabels(t *testing.T) {
+	r, err := parseHashLabels("user_id:256,session:4")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if r["user_id"] != 256 || r["session"] != 4 || len(r) != 2 {
+		t.Errorf("unexpected buckets %v", r)
+	}
+	for _, spec := range []string{"user_id", "user_id:0", "user_id:x", ":4"} {
+		if _, err := parseHashLabels(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestWriteSocketMetricsHashLabel(t *testing.T) {
+	*graphitePrefix = ""
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "user_id", "code")
+	for i := 0; i < 100; i++ {
+		d, _ := m.GetDatum(fmt.Sprintf("user%d", i), "200")
+		datum.SetInt(d, 1, ts)
+	}
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.hashLabels = map[string]uint32{"user_id": 4}
+	target := pushOptions{
+		name:    "graphite",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	b := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(b, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) > 4 {
+		t.Errorf("expected at most 4 buckets, received %q", lines)
+	}
+	total := 0
+	for _, line := range lines {
+		var path string
+		var v, ts int
+		if _, err := fmt.Sscanf(line, "%s %d %d", &path, &v, &ts); err != nil {
+			t.Fatalf("couldn't parse %q: %s", line, err)
+		}
+		if !strings.HasPrefix(path, "prog.requests.code.200.user_id.bucket") {
+			t.Errorf("unexpected path %q", path)
+		}
+		total += v
+	}
+	if total != 100 {
+		t.Errorf("expected buckets to sum to 100, received %d", total)
+	}
+	if r := hashBucket("user7", 4); r != hashBucket("user7", 4) {
+		t.Errorf("hash not stable")
+	}
+}
+
+func TestWriteSocketMetricsHashLabelConstLabels(t *testing.T) {
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	*graphitePrefix = ""
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("req", "prog", metrics.Counter, metrics.Int, "user")
+	d, _ := m.GetDatum("alice")
+	datum.SetInt(d, 1, ts)
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.hashLabels = map[string]uint32{"user": 4}
+	e.constLabels = map[string]string{"region": "eu"}
+	target := pushOptions{
+		name:    "graphite",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	b := &bytes.Buffer{}
+	if _, err := e.writeSocketMetrics(b, target); err != nil {
+		t.Fatalf("writeSocketMetrics failed: %s", err)
+	}
+	expected := "prog.req.region.eu.user." + hashBucket("alice", 4) + " 1 1343124840\n"
+	if diff := cmp.Diff(expected, b.String()); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
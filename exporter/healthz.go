@@ -0,0 +1,72 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var (
+	healthzRequireAll = flag.Bool("healthz_require_all_targets", false,
+		"If true, /healthz reports healthy only when every push target has succeeded recently, instead of at least one.")
+)
+
+// healthy reports whether the push targets have succeeded within the last
+// push interval, and the status of each target by name.  Pushes are allowed
+// the write deadline to complete, so a push that is in progress at the end of
+// the interval doesn't make the target unhealthy.  Time spent in a maintenance
+// window doesn't count, so the health of each target is held while a window
+// is open.
+func (e *Exporter) healthy(now time.Time) (bool, map[string]bool) {
+	names := e.targetNames()
+	if len(names) == 0 {
+		return true, nil
+	}
+	window := time.Duration(*pushInterval)*time.Second + *writeDeadline
+	status := make(map[string]bool, len(names))
+	up := 0
+	e.lastSuccessMu.RLock()
+	defer e.lastSuccessMu.RUnlock()
+	for _, name := range names {
+		t, ok := e.lastSuccess[name]
+		status[name] = ok && e.maintenance.age(t, now) <= window
+		if status[name] {
+			up++
+		}
+	}
+	if *healthzRequireAll {
+		return up == len(names), status
+	}
+	return up > 0, status
+}
+
+// HandleHealthz reports whether metrics are being exported via HTTP, for use
+// by load balancers and readiness checks.  It returns 200 when the push
+// targets are healthy and 503 otherwise.  If there are no push targets, it
+// always returns 200.
+func (e *Exporter) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	ok, status := e.healthy(time.Now())
+	w.Header().Set("Content-type", "text/plain")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	var names []string
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		state := "down"
+		if status[name] {
+			state = "up"
+		}
+		fmt.Fprintf(w, "%s %s\n", name, state)
+	}
+}
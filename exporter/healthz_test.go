@@ -0,0 +1,92 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+)
+
+var handleHealthzTests = []struct {
+	name       string
+	requireAll bool
+	ages       map[string]time.Duration // Age of the last success of each target; absent targets have never succeeded.
+	code       int
+	expected   string
+}{
+	{"no targets",
+		false,
+		nil,
+		http.StatusOK,
+		"",
+	},
+	{"never pushed",
+		false,
+		map[string]time.Duration{},
+		http.StatusServiceUnavailable,
+		"graphite down\nstatsd down\n",
+	},
+	{"one up",
+		false,
+		map[string]time.Duration{"graphite": 10 * time.Second},
+		http.StatusOK,
+		"graphite up\nstatsd down\n",
+	},
+	{"one up require all",
+		true,
+		map[string]time.Duration{"graphite": 10 * time.Second},
+		http.StatusServiceUnavailable,
+		"graphite up\nstatsd down\n",
+	},
+	{"all up require all",
+		true,
+		map[string]time.Duration{"graphite": 10 * time.Second, "statsd": 65 * time.Second},
+		http.StatusOK,
+		"graphite up\nstatsd up\n",
+	},
+	{"stale",
+		false,
+		map[string]time.Duration{"graphite": 2 * time.Minute, "statsd": 71 * time.Second},
+		http.StatusServiceUnavailable,
+		"graphite down\nstatsd down\n",
+	},
+}
+
+func TestHandleHealthz(t *testing.T) {
+	defer func(v bool) { *healthzRequireAll = v }(*healthzRequireAll)
+	for _, tc := range handleHealthzTests {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+			if err != nil {
+				t.Fatalf("couldn't make exporter: %s", err)
+			}
+			*healthzRequireAll = tc.requireAll
+			if tc.ages != nil {
+				e.RegisterPushExport(pushOptions{name: "graphite"})
+				e.RegisterPushExport(pushOptions{name: "statsd"})
+			}
+			for name, age := range tc.ages {
+				e.lastSuccess[name] = time.Now().Add(-age)
+			}
+			response := httptest.NewRecorder()
+			e.HandleHealthz(response, &http.Request{})
+			if response.Code != tc.code {
+				t.Errorf("response code: expected %d, received %d", tc.code, response.Code)
+			}
+			b, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Errorf("failed to read response %s", err)
+			}
+			if diff := cmp.Diff(tc.expected, string(b)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
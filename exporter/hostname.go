@@ -0,0 +1,73 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"os"
+	"regexp"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+var (
+	exportHostname = flag.String("export_hostname", "",
+		"Hostname to export metrics with.  If empty or unusable, the hostname of the system is used.")
+	hostnameBadPattern = flag.String("hostname_bad_pattern", "",
+		"Regular expression matching hostnames that are not meaningful, e.g. ^[0-9a-f]{12}$ for container IDs.  A hostname that matches is skipped in favour of the next source.")
+	hostnameRequired = flag.Bool("hostname_required", false,
+		"If true, mtail refuses to start when no source gives a usable hostname, instead of exporting with an empty or unusable one.")
+
+	// osHostname returns the hostname of the system; a variable so tests can
+	// replace it.
+	osHostname = os.Hostname
+)
+
+// resolveHostname returns the hostname to export metrics with.  The sources
+// are tried in order: the hostname given in the exporter options, the
+// export_hostname flag, then the hostname of the system.  A hostname that is
+// empty or matches hostname_bad_pattern is skipped.  If no source gives a
+// usable hostname, an error is returned if hostname_required is set, and
+// otherwise the hostname of the system is used anyway.
+func resolveHostname(option string) (string, error) {
+	var bad *regexp.Regexp
+	if *hostnameBadPattern != "" {
+		var err error
+		bad, err = regexp.Compile(*hostnameBadPattern)
+		if err != nil {
+			return "", errors.Wrap(err, "parsing hostname_bad_pattern")
+		}
+	}
+	system, err := osHostname()
+	if err != nil {
+		glog.Infof("Couldn't get the system hostname: %s", err)
+	}
+	sources := []struct {
+		name, hostname string
+	}{
+		{"exporter options", option},
+		{"export_hostname", *exportHostname},
+		{"system", system},
+	}
+	for _, s := range sources {
+		switch {
+		case s.hostname == "":
+			glog.V(1).Infof("No hostname from %s", s.name)
+		case bad != nil && bad.MatchString(s.hostname):
+			glog.Infof("Hostname %q from %s matches hostname_bad_pattern, skipping it", s.hostname, s.name)
+		default:
+			glog.Infof("Exporting with hostname %q from %s", s.hostname, s.name)
+			return s.hostname, nil
+		}
+	}
+	if *hostnameRequired {
+		return "", errors.New("no usable hostname, and hostname_required is set")
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "getting hostname")
+	}
+	glog.Warningf("No usable hostname; exporting with system hostname %q", system)
+	return system, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveHostname(t *testing.T) {
+	defer func(f func() (string, error)) { osHostname = f }(osHostname)
+	defer func(s string) { *exportHostname = s }(*exportHostname)
+	defer func(s string) { *hostnameBadPattern = s }(*hostnameBadPattern)
+	defer func(b bool) { *hostnameRequired = b }(*hostnameRequired)
+
+	tests := []struct {
+		name     string
+		option   string
+		flag     string
+		system   string
+		required bool
+		expected string
+		err      bool
+	}{
+		{"option", "gunstar", "flag", "system", false, "gunstar", false},
+		{"flag", "", "flag", "system", false, "flag", false},
+		{"system", "", "", "system", false, "system", false},
+		{"bad option", "0123456789ab", "", "system", false, "system", false},
+		{"bad system", "", "", "0123456789ab", false, "0123456789ab", false},
+		{"bad system required", "", "", "0123456789ab", true, "", true},
+		{"empty required", "", "", "", true, "", true},
+	}
+	*hostnameBadPattern = "^[0-9a-f]{12}$"
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			*exportHostname = tc.flag
+			*hostnameRequired = tc.required
+			osHostname = func() (string, error) { return tc.system, nil }
+			h, err := resolveHostname(tc.option)
+			if tc.err != (err != nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if h != tc.expected {
+				t.Errorf("expected hostname %q, received %q", tc.expected, h)
+			}
+		})
+	}
+
+	*hostnameRequired = false
+	osHostname = func() (string, error) { return "", errors.New("no hostname") }
+	if _, err := resolveHostname(""); err == nil {
+		t.Errorf("expected error when the system hostname fails")
+	}
+	*hostnameBadPattern = "("
+	if _, err := resolveHostname("gunstar"); err == nil {
+		t.Errorf("expected error for a bad hostname_bad_pattern")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+var (
+	idempotencyKeys = flag.Bool("metric_push_idempotency_keys", false,
+		"If true, each request to Azure Monitor and InfluxDB carries an Idempotency-Key header derived from a hash of its content and a sequence number.  The key stays the same when the request is retried, so a backend that honours it doesn't count a retried request twice.")
+	httpRetries = flag.Int("metric_push_http_retries", 0,
+		"Number of times a request to Azure Monitor or InfluxDB is retried within a push if it fails or the backend returns a server error.")
+
+	httpPushRetried = expvar.NewMap("metric_push_http_retried_total")
+
+	// idempotencySeq numbers the requests to the HTTP push targets.
+	idempotencySeq uint64
+)
+
+// idempotencyKey returns the key of a request with the given body and
+// sequence number.
+func idempotencyKey(body []byte, seq uint64) string {
+	h := sha256.Sum256(body)
+	return fmt.Sprintf("%x-%d", h[:16], seq)
+}
+
+// doHTTPPush sends a request with the given body to the named HTTP push
+// target.  If metric_push_idempotency_keys is set, the request is given an
+// Idempotency-Key.  If the request fails or the target returns a server
+// error, it is sent again, with the same key, up to metric_push_http_retries
+// times; each attempt reads the body afresh.  The caller checks the status of
+// the response it returns.
+func doHTTPPush(name string, client *http.Client, req *http.Request, body []byte) (*http.Response, error) {
+	if *idempotencyKeys {
+		req.Header.Set("Idempotency-Key", idempotencyKey(body, atomic.AddUint64(&idempotencySeq, 1)))
+	}
+	req.ContentLength = int64(len(body))
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			httpPushRetried.Add(name, 1)
+		}
+		if len(body) > 0 {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := client.Do(req)
+		if attempt >= *httpRetries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+		if err == nil {
+			glog.V(1).Infof("retrying %s push: %s", name, resp.Status)
+			resp.Body.Close()
+		} else {
+			glog.V(1).Infof("retrying %s push: %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	a := idempotencyKey([]byte("foo 1\n"), 1)
+	if a != idempotencyKey([]byte("foo 1\n"), 1) {
+		t.Errorf("expected the same key for the same body and sequence")
+	}
+	if a == idempotencyKey([]byte("foo 1\n"), 2) {
+		t.Errorf("expected a different key for a different sequence")
+	}
+	if a == idempotencyKey([]byte("foo 2\n"), 1) {
+		t.Errorf("expected a different key for a different body")
+	}
+}
+
+func TestWriteInfluxMetricsRetriesWithIdempotencyKey(t *testing.T) {
+	defer func(b bool) { *idempotencyKeys = b }(*idempotencyKeys)
+	defer func(n int) { *httpRetries = n }(*httpRetries)
+	*idempotencyKeys = true
+	*httpRetries = 1
+
+	var keys, bodies []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		// Fail the first attempt of each push.
+		if len(keys)%2 == 1 {
+			http.Error(w, "timeout", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.influx, err = newInfluxClient(s.URL, "org", "bucket", "")
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := e.writeInfluxMetrics(); err != nil {
+			t.Fatalf("push %d failed: %s", i, err)
+		}
+	}
+	if len(keys) != 4 {
+		t.Fatalf("expected 4 requests, received %d", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("expected retry to carry the same key, received %q and %q", keys[0], keys[1])
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("expected retry to carry the same body, received %q and %q", bodies[0], bodies[1])
+	}
+	if keys[2] == keys[0] {
+		t.Errorf("expected a new key for the next push, received %q", keys[2])
+	}
+	if r := httpPushRetried.Get(influxTargetName).String(); r != "2" {
+		t.Errorf("expected 2 retries, received %s", r)
+	}
+}
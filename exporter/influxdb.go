@@ -0,0 +1,150 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"github.com/pkg/errors"
+)
+
+const influxTargetName = "influxdb2"
+
+var (
+	influxURL = flag.String("influxdb2_url", "",
+		"Base URL of an InfluxDB 2 server to push metrics to, e.g. http://localhost:8086.")
+	influxOrg = flag.String("influxdb2_org", "",
+		"InfluxDB 2 organization that owns the bucket.")
+	influxBucket = flag.String("influxdb2_bucket", "",
+		"InfluxDB 2 bucket to write metrics to.")
+	influxToken = flag.String("influxdb2_token", "",
+		"InfluxDB 2 API token with write access to the bucket.")
+
+	influxExportTotal   = expvar.NewInt("influxdb2_export_total")
+	influxExportSuccess = expvar.NewInt("influxdb2_export_success")
+)
+
+// influxClient writes metrics to the write API of an InfluxDB 2 server.
+type influxClient struct {
+	client *http.Client
+	url    string // URL of the write API, including the org and bucket.
+	token  string
+}
+
+func newInfluxClient(base, org, bucket, token string) (*influxClient, error) {
+	if org == "" || bucket == "" {
+		return nil, errors.New("influxdb2_org and influxdb2_bucket must be set to push to influxdb2_url")
+	}
+	q := url.Values{"org": {org}, "bucket": {bucket}, "precision": {"s"}}
+	return &influxClient{
+		client: &http.Client{Timeout: *writeDeadline},
+		url:    strings.TrimRight(base, "/") + "/api/v2/write?" + q.Encode(),
+		token:  token,
+	}, nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxFormatter returns a formatter that encodes a series of a metric as a
+// line of the InfluxDB line protocol: the metric name is the measurement, the
+// labels and, unless omitProg is set, the program are tags, and the value is
+// the field "value".  The timestamp is moved by the timestamp jitter like
+// those of the other push targets.  There is no InfluxDB v1 target in mtail
+// to share an encoder with, so this is the only line protocol encoder; it is
+// a formatter so that a target writing line protocol to a socket can use it
+// as is.  The metric lock is held before entering the formatter.
+func influxFormatter(omitProg bool) formatter {
+	return func(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+		tags := make(map[string]string, len(l.Labels)+1)
+		for k, v := range l.Labels {
+			tags[k] = v
+		}
+		if !omitProg {
+			tags["prog"] = m.Program
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b bytes.Buffer
+		b.WriteString(influxMeasurementEscaper.Replace(m.Name))
+		for _, k := range keys {
+			// The line protocol doesn't allow empty tag values.
+			if tags[k] == "" {
+				continue
+			}
+			b.WriteString("," + influxTagEscaper.Replace(k) + "=" + influxTagEscaper.Replace(tags[k]))
+		}
+		b.WriteString(" value=" + pushValueString(l.Datum))
+		if l.Datum.Type() == datum.Int {
+			b.WriteString("i")
+		}
+		b.WriteString(" " + pushTimeString(hostname, l) + "\n")
+		return b.String()
+	}
+}
+
+// writeInfluxMetrics writes every metric in the store to InfluxDB in a single
+// request.
+func (e *Exporter) writeInfluxMetrics() error {
+	var body bytes.Buffer
+	f := influxFormatter(e.o.OmitProgLabel)
+	e.store.RLock()
+	count := 0
+	for _, ml := range e.store.Metrics {
+		for _, m := range ml {
+			if !e.pushes(m, influxTargetName) {
+				continue
+			}
+			m.RLock()
+			lc := make(chan *metrics.LabelSet)
+			go e.emitLabelSets(m, lc)
+			for l := range lc {
+				body.WriteString(f(e.o.Hostname, m, l))
+			}
+			m.RUnlock()
+			count++
+		}
+	}
+	e.store.RUnlock()
+	influxExportTotal.Add(int64(count))
+	if count == 0 {
+		return nil
+	}
+
+	i := e.influx
+	req, err := http.NewRequest("POST", i.url, nil)
+	if err != nil {
+		return err
+	}
+	if i.token != "" {
+		req.Header.Set("Authorization", "Token "+i.token)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := doHTTPPush(influxTargetName, i.client, req, body.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	influxExportSuccess.Add(int64(count))
+	return nil
+}
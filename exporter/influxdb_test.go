@@ -0,0 +1,97 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestMetricToInflux(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "path", "code")
+	d, _ := m.GetDatum("/a b,c", "")
+	datum.SetInt(d, 37, ts)
+	r := FakeSocketWrite(influxFormatter(false), m)
+	expected := []string{"requests,path=/a\\ b\\,c,prog=prog value=37i 1343124840\n"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("line didn't match:\n%s", diff)
+	}
+
+	g := metrics.NewMetric("load avg", "prog", metrics.Gauge, metrics.Float)
+	d, _ = g.GetDatum()
+	datum.SetFloat(d, 0.5, ts)
+	r = FakeSocketWrite(influxFormatter(true), g)
+	expected = []string{"load\\ avg value=0.5 1343124840\n"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("line didn't match:\n%s", diff)
+	}
+}
+
+func TestMetricToInfluxJitter(t *testing.T) {
+	defer func(d time.Duration) { *timestampJitter = d }(*timestampJitter)
+	*timestampJitter = 10 * time.Second
+	ts := time.Unix(1343124840, 0)
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, ts)
+	l := &metrics.LabelSet{Labels: map[string]string{}, Datum: d}
+	expected := "foo,prog=prog value=1i " + pushTimeString("gunstar", l) + "\n"
+	if r := influxFormatter(false)("gunstar", m, l); r != expected {
+		t.Errorf("expected jittered timestamp %q, received %q", expected, r)
+	}
+	if pushTimeString("gunstar", l) == "1343124840" {
+		t.Errorf("expected gunstar's timestamp to be jittered")
+	}
+}
+
+func TestWriteInfluxMetrics(t *testing.T) {
+	var query, auth, body string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, auth = r.URL.Path+"?"+r.URL.RawQuery, r.Header.Get("Authorization")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.influx, err = newInfluxClient(s.URL+"/", "org", "bucket", "secret")
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+	if err := e.writeInfluxMetrics(); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	if query != "/api/v2/write?bucket=bucket&org=org&precision=s" {
+		t.Errorf("unexpected request %q", query)
+	}
+	if auth != "Token secret" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+	if body != "foo,prog=prog value=1i 1343124840\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestNewInfluxClientNeedsBucket(t *testing.T) {
+	if _, err := newInfluxClient("http://localhost:8086", "org", "", ""); err == nil {
+		t.Errorf("expected error without a bucket")
+	}
+}
@@ -9,15 +9,24 @@ import (
 	"net/http"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
 )
 
 var (
 	exportJSONErrors = expvar.NewInt("exporter_json_errors")
 )
 
-// HandleJSON exports the metrics in JSON format via HTTP.
+// HandleJSON exports the metrics in JSON format via HTTP, with the constant
+// labels added.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	b, err := json.MarshalIndent(e.store, "", "  ")
+	e.updateLabelCardinality()
+	e.store.RLock()
+	ms := make([]*metrics.Metric, 0)
+	for _, ml := range e.store.Metrics {
+		ms = append(ms, ml...)
+	}
+	b, err := json.MarshalIndent(e.withConstLabels(ms), "", "  ")
+	e.store.RUnlock()
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
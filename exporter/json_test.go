@@ -119,3 +119,49 @@ func TestHandleJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleJSONConstLabels(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int, "zone")
+	d, _ := m.GetDatum("a")
+	datum.SetInt(d, 1, time.Unix(0, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.constLabels = map[string]string{"region": "us-east1", "zone": "b"}
+	response := httptest.NewRecorder()
+	e.HandleJSON(response, &http.Request{})
+	// The series' own zone label takes precedence over the constant label.
+	expected := `[
+  {
+    "Name": "foo",
+    "Program": "test",
+    "Kind": 1,
+    "Type": 0,
+    "Keys": [
+      "zone",
+      "region"
+    ],
+    "LabelValues": [
+      {
+        "Labels": [
+          "a",
+          "us-east1"
+        ],
+        "Value": {
+          "Value": 1,
+          "Time": 0
+        }
+      }
+    ]
+  }
+]`
+	if diff := cmp.Diff(expected, response.Body.String()); diff != "" {
+		t.Error(diff)
+	}
+	if len(m.Keys) != 1 || len(m.LabelValues[0].Labels) != 1 {
+		t.Errorf("constant labels added to the metric in the store: %v", m)
+	}
+}
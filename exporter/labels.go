@@ -0,0 +1,151 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+// BuildLabels is a comma separated list of label=value pairs added to every
+// exported series.  It is set when mtail is built, with the linker flag
+// -X github.com/google/mtail/exporter.BuildLabels=region=us-east1,team=web.
+var BuildLabels string
+
+var extraLabels = flag.String("metric_extra_labels", "",
+	"Comma separated list of label=value pairs, e.g. region=us-east1,cluster=a, added to every exported series.  These override the labels of the same name built into mtail; an empty value, e.g. region=, removes a built in label.")
+
+// parseConstLabels parses a comma separated list of label=value pairs.
+func parseConstLabels(s string) (map[string]string, error) {
+	r := make(map[string]string)
+	if s == "" {
+		return r, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		i := strings.Index(item, "=")
+		if i < 1 {
+			return nil, errors.Errorf("%q is not a label=value pair", item)
+		}
+		r[item[:i]] = item[i+1:]
+	}
+	return r, nil
+}
+
+// constLabels returns the labels to add to every series: the labels built
+// into mtail, overridden by the labels given at run time.  Labels with empty
+// values are left out.
+func constLabels(build, run string) (map[string]string, error) {
+	labels, err := parseConstLabels(build)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing build labels")
+	}
+	overrides, err := parseConstLabels(run)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing metric_extra_labels")
+	}
+	for k, v := range overrides {
+		labels[k] = v
+	}
+	for k, v := range labels {
+		if v == "" {
+			delete(labels, k)
+		}
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// emitLabelSets sends the LabelSets of the metric on c, with the constant
+// labels added, and closes c.  A label of the series takes precedence over a
+// constant label of the same name.
+func (e *Exporter) emitLabelSets(m *metrics.Metric, c chan *metrics.LabelSet) {
+	if e.constLabels == nil {
+		m.EmitLabelSets(c)
+		return
+	}
+	lc := make(chan *metrics.LabelSet)
+	go m.EmitLabelSets(lc)
+	for l := range lc {
+		for k, v := range e.constLabels {
+			if _, ok := l.Labels[k]; !ok {
+				l.Labels[k] = v
+			}
+		}
+		c <- l
+	}
+	close(c)
+}
+
+// withConstLabels returns the metrics with the constant labels added to their
+// keys and to each of their series, for exports that write whole metrics
+// rather than LabelSets.  A key of a metric takes precedence over a constant
+// label of the same name.  Metrics with no constant labels to add are
+// returned as they are, and the others are copied.  The store lock is held
+// before entering this function.
+func (e *Exporter) withConstLabels(ms []*metrics.Metric) []*metrics.Metric {
+	if e.constLabels == nil {
+		return ms
+	}
+	r := make([]*metrics.Metric, 0, len(ms))
+	for _, m := range ms {
+		m.RLock()
+		r = append(r, e.labelledMetric(m))
+		m.RUnlock()
+	}
+	return r
+}
+
+// labelledMetric returns a copy of m with the constant labels added, or m if
+// it has every constant label as a key.  The metric lock is held before
+// entering this function.
+func (e *Exporter) labelledMetric(m *metrics.Metric) *metrics.Metric {
+	var keys []string
+	for k := range e.constLabels {
+		if !hasKey(m.Keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return m
+	}
+	sort.Strings(keys)
+	c := &metrics.Metric{
+		Name:             m.Name,
+		Program:          m.Program,
+		Kind:             m.Kind,
+		Type:             m.Type,
+		Hidden:           m.Hidden,
+		ExportEvery:      m.ExportEvery,
+		ResetAfterExport: m.ResetAfterExport,
+		Public:           m.Public,
+		ExportTo:         m.ExportTo,
+		Keys:             append(append([]string{}, m.Keys...), keys...),
+		LabelValues:      make([]*metrics.LabelValue, 0, len(m.LabelValues)),
+		Source:           m.Source,
+	}
+	for _, lv := range m.LabelValues {
+		labels := append([]string{}, lv.Labels...)
+		for _, k := range keys {
+			labels = append(labels, e.constLabels[k])
+		}
+		c.LabelValues = append(c.LabelValues, &metrics.LabelValue{Labels: labels, Value: lv.Value})
+	}
+	return c
+}
+
+// hasKey returns true if k is one of keys.
+func hasKey(keys []string, k string) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestConstLabels(t *testing.T) {
+	r, err := constLabels("region=us-east1,team=web,cluster=a", "team=db,cluster=")
+	if err != nil {
+		t.Fatalf("constLabels failed: %s", err)
+	}
+	if diff := cmp.Diff(map[string]string{"region": "us-east1", "team": "db"}, r); diff != "" {
+		t.Errorf("labels didn't match:\n%s", diff)
+	}
+	if r, err := constLabels("", ""); err != nil || r != nil {
+		t.Errorf("expected no labels, received %v, %v", r, err)
+	}
+	if _, err := constLabels("region", ""); err == nil {
+		t.Errorf("expected error for a label without a value")
+	}
+	if _, err := constLabels("", "=x"); err == nil {
+		t.Errorf("expected error for a value without a label")
+	}
+}
+
+func TestEmitLabelSetsConstLabels(t *testing.T) {
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "region")
+	d, _ := m.GetDatum("eu")
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	e := &Exporter{constLabels: map[string]string{"region": "us", "team": "web"}}
+	lc := make(chan *metrics.LabelSet)
+	go e.emitLabelSets(m, lc)
+	var received []map[string]string
+	for l := range lc {
+		received = append(received, l.Labels)
+	}
+	// The series label takes precedence over the constant label.
+	if diff := cmp.Diff([]map[string]string{{"region": "eu", "team": "web"}}, received); diff != "" {
+		t.Errorf("labels didn't match:\n%s", diff)
+	}
+}
+
+func TestWriteSocketMetricsConstLabelsStablePath(t *testing.T) {
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	*graphitePrefix = ""
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	d, _ := m.GetDatum("200")
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.constLabels = map[string]string{"region": "eu", "team": "web", "cluster": "a", "zone": "b"}
+	target := pushOptions{
+		name:    "graphite",
+		f:       metricToGraphite,
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	expected := "prog.requests.cluster.a.code.200.region.eu.team.web.zone.b 1 1343124840\n"
+	// Push several times, as the order of a map is only sometimes different.
+	for i := 0; i < 20; i++ {
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+		if diff := cmp.Diff(expected, b.String()); diff != "" {
+			t.Fatalf("push %d: path didn't match:\n%s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// errMaintenance is returned by a push that was queued rather than sent,
+// because a maintenance window is open.
+var errMaintenance = errors.New("maintenance window open, push queued")
+
+// maintenanceWindow records the latest planned maintenance window of the push
+// targets.
+type maintenanceWindow struct {
+	mu          sync.RWMutex
+	from, until time.Time
+}
+
+// open reports whether the window is open at now.
+func (w *maintenanceWindow) open(now time.Time) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return now.Before(w.until)
+}
+
+// set opens the window from now until the given time; a time not after now
+// closes it.  A window that is already open keeps its start.
+func (w *maintenanceWindow) set(now, until time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !now.Before(w.until) {
+		w.from = now
+	}
+	w.until = until
+}
+
+// age returns how long before now t was, leaving out the time that the window
+// was open, so that the health of a target measured by the age of its last
+// success doesn't change while the window is open.
+func (w *maintenanceWindow) age(t, now time.Time) time.Duration {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	age := now.Sub(t)
+	from, until := w.from, w.until
+	if from.Before(t) {
+		from = t
+	}
+	if until.After(now) {
+		until = now
+	}
+	if until.After(from) {
+		age -= until.Sub(from)
+	}
+	return age
+}
+
+func (w *maintenanceWindow) end() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.until
+}
+
+// HandleMaintenance reports and sets the maintenance window of the push
+// targets.  A POST with a duration in the "for" parameter, e.g. for=30m,
+// opens the window for that long from now, and for=0 closes it.  While the
+// window is open, pushes to targets with a retry queue are queued instead of
+// sent, push failures are only logged at verbosity 1, and the health of the
+// targets stays as it was when the window opened.  The queued pushes are sent
+// on the first push after the window closes.
+func (e *Exporter) HandleMaintenance(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		d, err := time.ParseDuration(r.FormValue("for"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad maintenance duration: %s", err), http.StatusBadRequest)
+			return
+		}
+		e.maintenance.set(now, now.Add(d))
+		if d > 0 {
+			glog.Infof("Maintenance window open until %s", now.Add(d).Format(time.RFC3339))
+		} else {
+			glog.Info("Maintenance window closed")
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-type", "text/plain")
+	if e.maintenance.open(now) {
+		fmt.Fprintf(w, "maintenance until %s\n", e.maintenance.end().Format(time.RFC3339))
+		return
+	}
+	fmt.Fprintln(w, "no maintenance")
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestPushShardMaintenance(t *testing.T) {
+	*graphitePrefix = ""
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "maintenance",
+		net:     "tcp",
+		addr:    l.Addr().String(),
+		f:       metricToGraphite,
+		queues:  []*retryQueue{newRetryQueue("maintenance", 1000)},
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/maintenance", strings.NewReader(url.Values{"for": {"1h"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	e.HandleMaintenance(w, r)
+	if !strings.HasPrefix(w.Body.String(), "maintenance until ") {
+		t.Fatalf("maintenance not started: %q", w.Body.String())
+	}
+	if err := e.pushShard(target); err != errMaintenance {
+		t.Fatalf("expected push to be queued, received %v", err)
+	}
+	if n := len(target.queues[0].batches); n != 1 {
+		t.Errorf("expected 1 queued push, received %d", n)
+	}
+
+	w = httptest.NewRecorder()
+	e.HandleMaintenance(w, httptest.NewRequest("POST", "/maintenance?for=0", nil))
+	if w.Body.String() != "no maintenance\n" {
+		t.Fatalf("maintenance not ended: %q", w.Body.String())
+	}
+	datum.SetInt(d, 2, time.Unix(1343124900, 0))
+	if err := e.pushShard(target); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	expected := "prog.foo 1 1343124840\nprog.foo 2 1343124900\n"
+	if r := <-received; r != expected {
+		t.Errorf("expected queued and current push %q, received %q", expected, r)
+	}
+}
+
+func TestHandleMaintenanceBadDuration(t *testing.T) {
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	w := httptest.NewRecorder()
+	e.HandleMaintenance(w, httptest.NewRequest("POST", "/maintenance?for=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, received %d", w.Code)
+	}
+}
+
+func TestMaintenanceHoldsTargetHealth(t *testing.T) {
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.RegisterPushExport(pushOptions{name: "up"})
+	e.RegisterPushExport(pushOptions{name: "down"})
+	window := time.Duration(*pushInterval)*time.Second + *writeDeadline
+	start := time.Now()
+	e.lastSuccess["up"] = start
+	e.lastSuccess["down"] = start.Add(-2 * window)
+
+	e.maintenance.set(start, start.Add(time.Hour))
+	for _, tc := range []struct {
+		at       time.Duration
+		expected map[string]bool
+	}{
+		// During the window, both targets keep the state they had when it
+		// opened.
+		{30 * time.Minute, map[string]bool{"up": true, "down": false}},
+		// After the window, the time since the last success counts again.
+		{time.Hour + window/2, map[string]bool{"up": true, "down": false}},
+		{time.Hour + 2*window, map[string]bool{"up": false, "down": false}},
+	} {
+		_, status := e.healthy(start.Add(tc.at))
+		if diff := cmp.Diff(tc.expected, status); diff != "" {
+			t.Errorf("status at %s didn't match:\n%s", tc.at, diff)
+		}
+	}
+}
+
+func TestPushToTargetMaintenance(t *testing.T) {
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	pushes := 0
+	ok := clientTarget{"ok", func(*Exporter) error { pushes++; return nil }}
+	failing := clientTarget{"failing", func(*Exporter) error { pushes++; return errors.New("down") }}
+
+	now := time.Now()
+	e.maintenance.set(now, now.Add(time.Hour))
+	e.pushToTarget(ok)
+	e.pushToTarget(failing)
+	if pushes != 2 {
+		t.Errorf("expected 2 pushes, received %d", pushes)
+	}
+	// Neither push changes the health of its target.
+	if len(e.lastSuccess) != 0 {
+		t.Errorf("expected no successes recorded during maintenance, received %v", e.lastSuccess)
+	}
+
+	e.maintenance.set(time.Now(), time.Now())
+	e.pushToTarget(ok)
+	if _, recorded := e.lastSuccess["ok"]; !recorded {
+		t.Errorf("expected success recorded after maintenance")
+	}
+}
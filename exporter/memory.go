@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"runtime"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+var (
+	memoryLimit = flag.Uint64("metric_push_memory_limit_bytes", 0,
+		"If not 0, when the Go heap of mtail reaches 90% of this many bytes, pushes stop being buffered: the retry queues are dropped and metrics are written straight to the targets.  0 disables the check.")
+
+	memoryDegraded = expvar.NewMap("metric_push_memory_degraded_total")
+
+	// heapBytes returns the size of the Go heap; a variable so tests can
+	// replace it.
+	heapBytes = func() uint64 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+)
+
+// memoryConstrained reports whether the heap is within 10% of the memory
+// limit.
+func memoryConstrained() bool {
+	return *memoryLimit > 0 && heapBytes() >= *memoryLimit/10*9
+}
+
+// memoryState records which push targets are degraded because memory is
+// short, so that only changes of state are logged and counted.
+type memoryState struct {
+	mu       sync.Mutex
+	degraded map[string]bool // Targets currently pushed unbuffered, by name.
+}
+
+// set records whether the named target is degraded, and returns true if that
+// changed.
+func (s *memoryState) set(name string, degraded bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.degraded[name] == degraded {
+		return false
+	}
+	if s.degraded == nil {
+		s.degraded = make(map[string]bool)
+	}
+	s.degraded[name] = degraded
+	return true
+}
+
+// checkMemory degrades the push to the target if memory is short, and notes
+// the target's recovery once it isn't.
+func (e *Exporter) checkMemory(target *pushOptions) {
+	if !memoryConstrained() {
+		if e.memory.set(target.name, false) {
+			glog.Infof("Heap below metric_push_memory_limit_bytes of %d; pushing to %s buffered again", *memoryLimit, target.name)
+		}
+		return
+	}
+	dropped := degrade(target)
+	if e.memory.set(target.name, true) {
+		memoryDegraded.Add(target.name, 1)
+		glog.Warningf("Heap near metric_push_memory_limit_bytes of %d; pushing to %s unbuffered and dropping %d queued pushes", *memoryLimit, target.name, dropped)
+	}
+}
+
+// degrade switches a push to the target to write straight to the target
+// without buffering, and drops the pushes queued for retry to free their
+// memory.  It returns the number of pushes dropped.
+func degrade(target *pushOptions) int {
+	dropped := 0
+	if target.queues != nil {
+		dropped = target.queues[target.shard].discardAll()
+		target.queues = nil
+	}
+	target.unbuffered = true
+	return dropped
+}
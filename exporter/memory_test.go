@@ -0,0 +1,101 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestPushShardMemoryConstrained(t *testing.T) {
+	defer func(l uint64, f func() uint64) { *memoryLimit, heapBytes = l, f }(*memoryLimit, heapBytes)
+	*memoryLimit = 1000
+	heapBytes = func() uint64 { return 950 }
+	*graphitePrefix = ""
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 2, time.Unix(1343124900, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	q := newRetryQueue("memory", 1000)
+	q.add(makeBatch("prog.foo 1 1343124840\n"))
+	target := pushOptions{
+		name:    "memory",
+		net:     "tcp",
+		addr:    l.Addr().String(),
+		f:       metricToGraphite,
+		queues:  []*retryQueue{q},
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	if err := e.pushShard(target); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	// The queued push was dropped, and the current push written directly.
+	if r := <-received; r != "prog.foo 2 1343124900\n" {
+		t.Errorf("unexpected push %q", r)
+	}
+	if len(q.batches) != 0 || q.bytes != 0 {
+		t.Errorf("expected empty queue, got %d bytes in %d batches", q.bytes, len(q.batches))
+	}
+	if r := memoryDegraded.Get("memory").String(); r != "1" {
+		t.Errorf("expected 1 degraded push, received %s", r)
+	}
+}
+
+func TestCheckMemoryTransitions(t *testing.T) {
+	defer func(l uint64, f func() uint64) { *memoryLimit, heapBytes = l, f }(*memoryLimit, heapBytes)
+	*memoryLimit = 1000
+	heap := uint64(950)
+	heapBytes = func() uint64 { return heap }
+
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	q := newRetryQueue("transitions", 1000)
+	push := func() pushOptions {
+		q.add(makeBatch("prog.foo 1 1343124840\n"))
+		target := pushOptions{name: "transitions", queues: []*retryQueue{q}}
+		e.checkMemory(&target)
+		return target
+	}
+	for _, heap = range []uint64{950, 990, 100, 100, 950} {
+		target := push()
+		if constrained := heap >= 900; target.unbuffered != constrained {
+			t.Errorf("heap %d: expected unbuffered %v", heap, constrained)
+		}
+	}
+	// Only the two changes into the degraded state are counted, not each
+	// degraded push.
+	if r := memoryDegraded.Get("transitions").String(); r != "2" {
+		t.Errorf("expected 2 degraded transitions, received %s", r)
+	}
+}
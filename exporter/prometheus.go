@@ -5,22 +5,78 @@ package exporter
 
 import (
 	"expvar"
+	"flag"
 	"fmt"
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 )
 
 var (
+	staleAfter = flag.Duration("metrics_endpoint_stale_after", 0,
+		"If not 0, series not updated for this long are left out of /metrics, so that Prometheus marks them stale.  They stay in the store and are still pushed and served on /json.")
+
 	metricExportTotal = expvar.NewInt("metric_export_total")
 )
 
 const (
 	prometheusFormat = "%s{%s} %s\n"
+
+	prometheusTargetName = "prometheus"
+
+	typeConflictName = "mtail_export_type_conflict_total"
 )
 
+// typeConflicts counts the metrics skipped from /metrics because another
+// metric of a different type has the same Prometheus name, by name.  The
+// counter is added to the store on the first conflict, so it is only
+// exported by an mtail that has one.
+type typeConflicts struct {
+	m    *metrics.Metric
+	once sync.Once
+
+	mu     sync.Mutex
+	logged map[string]struct{} // Names already logged as conflicting.
+}
+
+func newTypeConflicts() *typeConflicts {
+	return &typeConflicts{
+		m:      metrics.NewMetric(typeConflictName, "mtail", metrics.Counter, metrics.Int, "name"),
+		logged: make(map[string]struct{}),
+	}
+}
+
+// add counts a metric skipped because its type differs from the type already
+// exported under the same name, logging the first time each name conflicts.
+// The metric's lock is not held before entering this function.
+func (c *typeConflicts) add(m *metrics.Metric, name, first, t string) {
+	d, _ := c.m.GetDatum(name)
+	datum.IncIntBy(d, 1, time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.logged[name]; !ok {
+		c.logged[name] = struct{}{}
+		glog.Warningf("Metric %s from program %s is a %s, but %s is already exported as a %s; skipping it", m.Name, m.Program, t, name, first)
+	}
+}
+
+// register adds the counter to the store, once.  The store lock is not held
+// before entering this function.
+func (c *typeConflicts) register(ms *metrics.Store) {
+	c.once.Do(func() {
+		c.m.Public = true
+		if err := ms.Add(c.m); err != nil {
+			glog.Infof("Couldn't add %s to the store: %s", c.m.Name, err)
+		}
+	})
+}
+
 func noHyphens(s string) string {
 	return strings.Replace(s, "-", "_", -1)
 }
@@ -28,28 +84,51 @@ func noHyphens(s string) string {
 // HandlePrometheusMetrics exports the metrics in a format readable by
 // Prometheus via HTTP.
 func (e *Exporter) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	e.updateLabelCardinality()
+	conflicted := false
+	defer func() {
+		if conflicted {
+			e.typeConflicts.register(e.store)
+		}
+	}()
 	e.store.RLock()
 	defer e.store.RUnlock()
 
 	w.Header().Add("Content-type", "text/plain; version=0.0.4")
 
-	for _, ml := range e.store.Metrics {
-		emittype := true
-		for _, m := range ml {
+	names := make([]string, 0, len(e.store.Metrics))
+	for n := range e.store.Metrics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	types := make(map[string]string) // Type emitted for each Prometheus name.
+	for _, n := range names {
+		for _, m := range e.store.Metrics[n] {
+			if !exportsTo(m, prometheusTargetName) {
+				continue
+			}
 			m.RLock()
 			metricExportTotal.Add(1)
 
-			if emittype {
-				fmt.Fprintf(w,
-					"# TYPE %s %s\n",
-					noHyphens(m.Name),
-					kindToPrometheusType(m.Kind))
-				emittype = false
+			name := noHyphens(m.Name)
+			t := kindToPrometheusType(m.Kind)
+			if first, ok := types[name]; !ok {
+				fmt.Fprintf(w, "# TYPE %s %s\n", name, t)
+				types[name] = t
+			} else if first != t {
+				m.RUnlock()
+				e.typeConflicts.add(m, name, first, t)
+				conflicted = true
+				continue
 			}
 
 			lc := make(chan *metrics.LabelSet)
-			go m.EmitLabelSets(lc)
+			go e.emitLabelSets(m, lc)
 			for l := range lc {
+				if *staleAfter > 0 && now.Sub(l.Datum.TimeUTC()) > *staleAfter {
+					continue
+				}
 				if m.Source != "" {
 					fmt.Fprintf(w, "# %s defined at %s\n", noHyphens(m.Name), m.Source)
 				}
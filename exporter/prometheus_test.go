@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -159,3 +160,65 @@ func TestHandlePrometheus(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlePrometheusTypeConflict(t *testing.T) {
+	ms := metrics.NewStore()
+	ms.Add(&metrics.Metric{
+		Name:        "conflict-total",
+		Program:     "test",
+		Kind:        metrics.Counter,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(1, time.Unix(0, 0))}}})
+	ms.Add(&metrics.Metric{
+		Name:        "conflict_total",
+		Program:     "test",
+		Kind:        metrics.Gauge,
+		LabelValues: []*metrics.LabelValue{{Labels: []string{}, Value: datum.MakeInt(2, time.Unix(0, 0))}}})
+	e, err := New(Options{ms, "gunstar", true})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	response := httptest.NewRecorder()
+	e.HandlePrometheusMetrics(response, &http.Request{})
+	expected := `# TYPE conflict_total counter
+conflict_total{} 1
+`
+	if diff := cmp.Diff(expected, response.Body.String()); diff != "" {
+		t.Error(diff)
+	}
+	d, _ := e.typeConflicts.m.GetDatum("conflict_total")
+	if r := d.ValueString(); r != "1" {
+		t.Errorf("expected 1 type conflict, received %s", r)
+	}
+
+	// The conflict counter is exported from then on.
+	response = httptest.NewRecorder()
+	e.HandlePrometheusMetrics(response, &http.Request{})
+	if !strings.Contains(response.Body.String(), "mtail_export_type_conflict_total{name=\"conflict_total\"} 2\n") {
+		t.Errorf("expected conflict counter in %q", response.Body.String())
+	}
+}
+
+func TestHandlePrometheusStaleAfter(t *testing.T) {
+	defer func(d time.Duration) { *staleAfter = d }(*staleAfter)
+	*staleAfter = time.Hour
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "test", metrics.Counter, metrics.Int, "age")
+	d, _ := m.GetDatum("old")
+	datum.SetInt(d, 1, time.Now().Add(-2*time.Hour))
+	d, _ = m.GetDatum("new")
+	datum.SetInt(d, 2, time.Now())
+	ms.Add(m)
+	e, err := New(Options{ms, "gunstar", true})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	response := httptest.NewRecorder()
+	e.HandlePrometheusMetrics(response, &http.Request{})
+	expected := `# TYPE foo counter
+foo{age="new"} 2
+`
+	if diff := cmp.Diff(expected, response.Body.String()); diff != "" {
+		t.Error(diff)
+	}
+}
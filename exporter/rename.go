@@ -0,0 +1,79 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/csv"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+var (
+	renameFile = flag.String("metric_push_rename_file", "",
+		"Path to a CSV file of internal,external metric names.  Metrics pushed to the targets in metric_push_rename_targets are renamed to their external name; metrics not in the file keep their name.  Lines starting with # are ignored.")
+	renameTargets = flag.String("metric_push_rename_targets", "collectd,graphite,statsd",
+		"Comma separated list of the push targets that metric_push_rename_file applies to, from collectd, graphite, statsd, fifo and csv.")
+)
+
+// loadRenames reads a CSV file of internal,external metric name pairs.
+func loadRenames(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRenames(f)
+}
+
+func readRenames(r io.Reader) (map[string]string, error) {
+	c := csv.NewReader(r)
+	c.Comment = '#'
+	c.FieldsPerRecord = 2
+	c.TrimLeadingSpace = true
+	m := make(map[string]string)
+	for {
+		rec, err := c.Read()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec[0] == "" || rec[1] == "" {
+			return nil, errors.Errorf("empty metric name in %q", rec)
+		}
+		if _, ok := m[rec[0]]; ok {
+			return nil, errors.Errorf("metric %q renamed more than once", rec[0])
+		}
+		m[rec[0]] = rec[1]
+	}
+}
+
+// parseRenameTargets parses the comma separated list of targets that renames
+// apply to.
+func parseRenameTargets(s string) (map[string]bool, error) {
+	targets := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !routeTargetNames[t] {
+			return nil, errors.Errorf("unknown target %q", t)
+		}
+		targets[t] = true
+	}
+	return targets, nil
+}
+
+// renamedMetric returns a copy of m under a new name, that holds no values,
+// for formatting the LabelSets of m under that name.
+func renamedMetric(m *metrics.Metric, name string) *metrics.Metric {
+	return metrics.NewMetric(name, m.Program, m.Kind, m.Type, m.Keys...)
+}
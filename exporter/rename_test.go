@@ -0,0 +1,108 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestReadRenames(t *testing.T) {
+	r, err := readRenames(strings.NewReader("# internal,external\nrequests, partner_requests\nerrors,partner_errors\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := map[string]string{"requests": "partner_requests", "errors": "partner_errors"}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("renames didn't match:\n%s", diff)
+	}
+	for _, in := range []string{"requests\n", "requests,a,b\n", ",a\n", "a,b\na,c\n"} {
+		if _, err := readRenames(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestWriteSocketMetricsRenamed(t *testing.T) {
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	*graphitePrefix = ""
+
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	for _, name := range []string{"requests", "errors"} {
+		m := metrics.NewMetric(name, "prog", metrics.Counter, metrics.Int)
+		d, _ := m.GetDatum()
+		datum.SetInt(d, 1, ts)
+		ms.Add(m)
+	}
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	renames := map[string]string{"requests": "partner_requests"}
+	for _, tc := range []struct {
+		renames  map[string]string
+		expected string
+	}{
+		{renames, "prog.errors 1 1343124840\nprog.partner_requests 1 1343124840\n"},
+		{nil, "prog.errors 1 1343124840\nprog.requests 1 1343124840\n"},
+	} {
+		target := pushOptions{
+			name:    "graphite",
+			f:       metricToGraphite,
+			renames: tc.renames,
+			total:   new(expvar.Int),
+			success: new(expvar.Int),
+		}
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, target); err != nil {
+			t.Fatalf("writeSocketMetrics failed: %s", err)
+		}
+		if diff := cmp.Diff(tc.expected, b.String()); diff != "" {
+			t.Errorf("lines didn't match:\n%s", diff)
+		}
+	}
+}
+
+func TestNewRenameTargets(t *testing.T) {
+	defer func(s string) { *renameFile = s }(*renameFile)
+	defer func(s string) { *renameTargets = s }(*renameTargets)
+	defer func(s string) { *graphiteHostPort = s }(*graphiteHostPort)
+	defer func(s string) { *statsdHostPort = s }(*statsdHostPort)
+	f, err := ioutil.TempFile("", "renames")
+	if err != nil {
+		t.Fatalf("couldn't make temp file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("requests,partner_requests\n")
+	f.Close()
+	*renameFile = f.Name()
+	*renameTargets = "graphite"
+	*graphiteHostPort = "localhost:2003"
+	*statsdHostPort = "localhost:8125"
+
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	for _, target := range e.pushTargets {
+		if renamed := target.renames != nil; renamed != (target.name == "graphite") {
+			t.Errorf("%s: renamed is %v", target.name, renamed)
+		}
+	}
+
+	*renameTargets = "prometheus"
+	if _, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"}); err == nil {
+		t.Errorf("expected error for an unknown rename target")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	retryQueueBytes = flag.Int("metric_push_retry_queue_bytes", 0,
+		"Maximum size in bytes of the in-memory queue of failed pushes kept for each push target, to retry on the next push.  The oldest pushes are dropped when the queue is full.  Only targets whose lines carry a timestamp, such as graphite, are retried; statsd isn't, as it would count replayed increments again.  0 disables retries.")
+	retryBudgetPerSecond = flag.Float64("metric_push_retry_budget_per_second", 0,
+		"If not 0, the rate of retries of failed pushes allowed across all push targets together.  When the budget is used up, the failed pushes queued for a target are dropped instead of retried.  0 allows unlimited retries.")
+	retryQueueHighWaterBatches = flag.Int("metric_push_retry_queue_high_water", 0,
+		"If a push fails and leaves more than this many pushes in the retry queue of a target, the queue is retried immediately instead of at the next push.  0 disables immediate retries.")
+
+	retryQueueSize      = expvar.NewMap("metric_push_retry_queue_size_bytes")
+	retryQueueDropped   = expvar.NewMap("metric_push_retry_queue_dropped_total")
+	retryQueueHighWater = expvar.NewMap("metric_push_retry_queue_high_water_total")
+	retryBudgetDropped  = expvar.NewMap("metric_push_retry_budget_dropped_total")
+	retryReplayed       = expvar.NewMap("metric_push_retry_replayed_total")
+)
+
+// retryBudget is a token bucket limiting the rate of retries across all push
+// targets.  It holds at most one second of tokens.
+type retryBudget struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second.
+	tokens float64
+	last   time.Time // Time tokens were last added.
+}
+
+func newRetryBudget(rate float64) *retryBudget {
+	return &retryBudget{rate: rate, tokens: burst(rate), last: time.Now()}
+}
+
+// burst returns the size of the bucket for a rate, which is at least one
+// token so that a rate below one per second allows any retries at all.
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// take removes a token from the budget at now, and reports whether there was
+// one to take.  A nil budget always has a token.
+func (b *retryBudget) take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if max := burst(b.rate); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// lineBatch is an io.Writer that records each write as a single line of a
+// push, so the push can be replayed later to a target.
+type lineBatch struct {
+	lines  []string
+	bytes  int
+	replay bool // If true, delivery of the batch has failed before.
+}
+
+func (b *lineBatch) Write(p []byte) (int, error) {
+	b.lines = append(b.lines, string(p))
+	b.bytes += len(p)
+	return len(p), nil
+}
+
+// retryQueue holds the pushes to a target that have not yet been delivered,
+// oldest first.
+type retryQueue struct {
+	mu      sync.Mutex
+	name    string // Name of the target, for reporting.
+	max     int    // Maximum number of bytes queued.
+	batches []*lineBatch
+	bytes   int // Total size of the batches.
+}
+
+func newRetryQueue(name string, max int) *retryQueue {
+	return &retryQueue{name: name, max: max}
+}
+
+// add appends a batch to the end of the queue.
+func (q *retryQueue) add(b *lineBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.batches = append(q.batches, b)
+	q.bytes += b.bytes
+	retryQueueSize.Add(q.name, int64(b.bytes))
+}
+
+// flush writes the queued batches to w, oldest first, removing each line from
+// the queue once it has been written.  It returns the number of lines written,
+// and how many of those were replayed from batches that had failed to be
+// delivered before.  If a write fails, the unwritten lines remain in the
+// queue, and the queue is trimmed to its maximum size.
+func (q *retryQueue) flush(w io.Writer) (int, int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count, replayed := 0, 0
+	for len(q.batches) > 0 {
+		b := q.batches[0]
+		for len(b.lines) > 0 {
+			if _, err := fmt.Fprint(w, b.lines[0]); err != nil {
+				q.trim()
+				return count, replayed, err
+			}
+			count++
+			if b.replay {
+				replayed++
+			}
+			q.remove(b, len(b.lines[0]))
+			b.lines = b.lines[1:]
+		}
+		q.batches = q.batches[1:]
+	}
+	return count, replayed, nil
+}
+
+// aboveHighWater returns true if the queue holds more pushes than the high
+// water mark.  It is safe to call on a nil queue.
+func (q *retryQueue) aboveHighWater() bool {
+	if q == nil || *retryQueueHighWaterBatches <= 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.batches) > *retryQueueHighWaterBatches
+}
+
+// retries reports whether the queue holds earlier pushes to retry, as well
+// as the latest push.
+func (q *retryQueue) retries() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.batches) > 1
+}
+
+// discardRetries drops every batch but the latest, and returns the number of
+// batches dropped.
+func (q *retryQueue) discardRetries() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for len(q.batches) > 1 {
+		b := q.batches[0]
+		q.remove(b, b.bytes)
+		q.batches = q.batches[1:]
+		retryQueueDropped.Add(q.name, 1)
+		n++
+	}
+	return n
+}
+
+// discardAll drops every batch in the queue, and returns the number of batches
+// dropped.
+func (q *retryQueue) discardAll() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.batches)
+	for _, b := range q.batches {
+		q.remove(b, b.bytes)
+		retryQueueDropped.Add(q.name, 1)
+	}
+	q.batches = nil
+	return n
+}
+
+// evict trims the queue to its maximum size, after a push has failed.
+func (q *retryQueue) evict() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.trim()
+}
+
+// trim drops the oldest batches until the queue is no larger than its
+// maximum size, after a push has failed, and marks the batches left as
+// replays.  The queue lock is held before entering this function.
+func (q *retryQueue) trim() {
+	for q.bytes > q.max && len(q.batches) > 0 {
+		b := q.batches[0]
+		q.remove(b, b.bytes)
+		q.batches = q.batches[1:]
+		retryQueueDropped.Add(q.name, 1)
+	}
+	for _, b := range q.batches {
+		b.replay = true
+	}
+}
+
+// remove accounts for n bytes of batch b leaving the queue.  The queue lock is
+// held before entering this function.
+func (q *retryQueue) remove(b *lineBatch, n int) {
+	b.bytes -= n
+	q.bytes -= n
+	retryQueueSize.Add(q.name, int64(-n))
+}
@@ -0,0 +1,281 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+)
+
+// failingWriter accepts a fixed number of writes and fails the rest.
+type failingWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errors.New("write failed")
+	}
+	w.n--
+	return w.Buffer.Write(b)
+}
+
+func makeBatch(lines ...string) *lineBatch {
+	b := &lineBatch{}
+	for _, l := range lines {
+		fmt.Fprint(b, l)
+	}
+	return b
+}
+
+func TestRetryQueue(t *testing.T) {
+	q := newRetryQueue("test", 100)
+	q.add(makeBatch("a 1\n", "b 1\n"))
+
+	// Write the first line and fail the second.
+	w := &failingWriter{n: 1}
+	n, replayed, err := q.flush(w)
+	if err == nil {
+		t.Errorf("expected flush error")
+	}
+	if n != 1 || replayed != 0 {
+		t.Errorf("expected 1 line written and none replayed, received %d and %d", n, replayed)
+	}
+	if q.bytes != 4 {
+		t.Errorf("expected 4 bytes queued, received %d", q.bytes)
+	}
+
+	q.add(makeBatch("a 2\n", "b 2\n"))
+	w = &failingWriter{n: 10}
+	n, replayed, err = q.flush(w)
+	if err != nil {
+		t.Errorf("unexpected flush error %s", err)
+	}
+	// Only the line left from the failed flush is a replay.
+	if n != 3 || replayed != 1 {
+		t.Errorf("expected 3 lines written and 1 replayed, received %d and %d", n, replayed)
+	}
+	if diff := cmp.Diff("b 1\na 2\nb 2\n", w.String()); diff != "" {
+		t.Errorf("flushed lines didn't match:\n%s", diff)
+	}
+	if q.bytes != 0 || len(q.batches) != 0 {
+		t.Errorf("expected empty queue, got %d bytes in %d batches", q.bytes, len(q.batches))
+	}
+}
+
+func TestRetryQueueEvict(t *testing.T) {
+	q := newRetryQueue("evict", 10)
+	q.add(makeBatch("a 1\n", "b 1\n"))
+	q.add(makeBatch("a 2\n", "b 2\n"))
+	q.add(makeBatch("a 3\n"))
+	q.evict()
+	if q.bytes != 4 || len(q.batches) != 1 {
+		t.Errorf("expected one batch of 4 bytes, got %d bytes in %d batches", q.bytes, len(q.batches))
+	}
+	if r := retryQueueDropped.Get("evict").String(); r != "2" {
+		t.Errorf("expected 2 dropped batches, received %s", r)
+	}
+	if r := retryQueueSize.Get("evict").String(); r != "4" {
+		t.Errorf("expected queue size 4, received %s", r)
+	}
+
+	w := &failingWriter{n: 10}
+	if _, _, err := q.flush(w); err != nil {
+		t.Errorf("unexpected flush error %s", err)
+	}
+	if diff := cmp.Diff("a 3\n", w.String()); diff != "" {
+		t.Errorf("flushed lines didn't match:\n%s", diff)
+	}
+}
+
+func TestPushShardHighWater(t *testing.T) {
+	defer func(n int) { *retryQueueHighWaterBatches = n }(*retryQueueHighWaterBatches)
+	*retryQueueHighWaterBatches = 2
+
+	// Find a port with nothing listening on it, so every push fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	target := pushOptions{
+		name:    "highwater",
+		net:     "tcp",
+		addr:    addr,
+		f:       metricToGraphite,
+		queues:  []*retryQueue{newRetryQueue("highwater", 1000)},
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	for i := 1; i <= 4; i++ {
+		if err := e.pushShard(target); err == nil {
+			t.Fatalf("push %d: expected error pushing to %s", i, addr)
+		}
+	}
+	// The queue is above the high water mark after the third and fourth pushes.
+	if r := retryQueueHighWater.Get("highwater").String(); r != "2" {
+		t.Errorf("expected 2 high water flushes, received %s", r)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1343124840, 0)
+	b := newRetryBudget(2)
+	b.last = now
+	for i := 0; i < 2; i++ {
+		if !b.take(now) {
+			t.Errorf("take %d: expected a token", i)
+		}
+	}
+	if b.take(now) {
+		t.Errorf("expected budget to be used up")
+	}
+	if !b.take(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected a token after half a second")
+	}
+	// The bucket holds at most a second of tokens.
+	later := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.take(later) {
+			t.Errorf("take %d: expected a token", i)
+		}
+	}
+	if b.take(later) {
+		t.Errorf("expected budget to be used up")
+	}
+	var nilBudget *retryBudget
+	if !nilBudget.take(now) {
+		t.Errorf("expected a nil budget to always have a token")
+	}
+}
+
+func TestPushShardRetryBudget(t *testing.T) {
+	// Find a port with nothing listening on it, so every push fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.retryBudget = newRetryBudget(0.001)
+	q := newRetryQueue("budget", 1000)
+	target := pushOptions{
+		name:    "budget",
+		net:     "tcp",
+		addr:    addr,
+		f:       metricToGraphite,
+		queues:  []*retryQueue{q},
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	for i := 1; i <= 3; i++ {
+		if err := e.pushShard(target); err == nil {
+			t.Fatalf("push %d: expected error pushing to %s", i, addr)
+		}
+	}
+	// The second push used the only token; the third dropped the two earlier pushes.
+	if r := retryBudgetDropped.Get("budget").String(); r != "2" {
+		t.Errorf("expected 2 pushes dropped, received %s", r)
+	}
+	if len(q.batches) != 1 {
+		t.Errorf("expected 1 queued push, received %d", len(q.batches))
+	}
+}
+
+func TestRegisterPushExportRetryQueues(t *testing.T) {
+	defer func(n int) { *retryQueueBytes = n }(*retryQueueBytes)
+	*retryQueueBytes = 1000
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.RegisterPushExport(pushOptions{name: "graphite", timestamps: true})
+	e.RegisterPushExport(pushOptions{name: "statsd"})
+	e.RegisterPushExport(pushOptions{name: "collectd", timestamps: true, reply: readCollectdReply})
+	queued := make(map[string]bool)
+	for _, target := range e.pushTargets {
+		queued[target.name] = len(target.queues) > 0
+	}
+	expected := map[string]bool{"graphite": true, "statsd": false, "collectd": false}
+	if diff := cmp.Diff(expected, queued); diff != "" {
+		t.Errorf("queues didn't match:\n%s", diff)
+	}
+}
+
+// closingWriter is a failingWriter that can be closed.
+type closingWriter struct {
+	failingWriter
+}
+
+func (w *closingWriter) Close() error { return nil }
+
+func TestPushShardCountsReplays(t *testing.T) {
+	*graphitePrefix = ""
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	// The first push fails to write anything, and the second succeeds.
+	writers := []*closingWriter{{failingWriter{n: 0}}, {failingWriter{n: 10}}}
+	open := func(pushOptions) (io.WriteCloser, error) {
+		w := writers[0]
+		writers = writers[1:]
+		return w, nil
+	}
+	target := pushOptions{
+		name:    "replays",
+		f:       metricToGraphite,
+		open:    open,
+		queues:  []*retryQueue{newRetryQueue("replays", 1000)},
+		total:   new(expvar.Int),
+		success: new(expvar.Int),
+	}
+	if err := e.pushShard(target); err == nil {
+		t.Fatalf("expected first push to fail")
+	}
+	if err := e.pushShard(target); err != nil {
+		t.Fatalf("push failed: %s", err)
+	}
+	// The line replayed from the failed push is counted apart from the line
+	// of the latest push.
+	if r := target.success.Value(); r != 1 {
+		t.Errorf("expected 1 line delivered on its first attempt, received %d", r)
+	}
+	if r := retryReplayed.Get("replays").String(); r != "1" {
+		t.Errorf("expected 1 replayed line, received %s", r)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/google/mtail/metrics/datum"
+)
+
+var roundDecimals = flag.Int("metric_push_round_decimals", -1,
+	"If 0 or more, float values are rounded to this many decimal places, halves away from zero, before they are pushed.  Integer values are not changed.  -1 disables rounding.")
+
+// roundTo rounds v to n decimal places, with halves rounded away from zero.
+// The value is first reduced to 15 significant digits, so that a value like
+// 1.005, which is stored as slightly less than its decimal value, is rounded
+// as written.
+func roundTo(v float64, n int) float64 {
+	p := math.Pow10(n)
+	x := math.Abs(v) * p
+	if math.IsInf(x, 0) || math.IsNaN(x) || x >= 1<<53 {
+		return v
+	}
+	x, _ = strconv.ParseFloat(strconv.FormatFloat(x, 'g', 15, 64), 64)
+	return math.Copysign(math.Floor(x+0.5)/p, v)
+}
+
+// pushValue returns the value of a Datum to push, rounded if
+// metric_push_round_decimals is set.
+func pushValue(d datum.Datum) float64 {
+	v := datumValue(d)
+	if d.Type() == datum.Float && *roundDecimals >= 0 {
+		v = roundTo(v, *roundDecimals)
+	}
+	return v
+}
+
+// pushValueString returns the value of a Datum to push as a string, rounded
+// if metric_push_round_decimals is set.
+func pushValueString(d datum.Datum) string {
+	if d.Type() != datum.Float || *roundDecimals < 0 {
+		return d.ValueString()
+	}
+	return fmt.Sprintf("%g", pushValue(d))
+}
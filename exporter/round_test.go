@@ -0,0 +1,75 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+var roundToTests = []struct {
+	v        float64
+	n        int
+	expected float64
+}{
+	{1.234, 2, 1.23},
+	{1.235, 2, 1.24},
+	{1.005, 2, 1.01},
+	{-1.005, 2, -1.01},
+	{2.5, 0, 3},
+	{-2.5, 0, -3},
+	{0.5, 0, 1},
+	{-0.4, 0, 0},
+	{1e300, 2, 1e300},
+	{1234.5678, 1, 1234.6},
+}
+
+func TestRoundTo(t *testing.T) {
+	for _, tc := range roundToTests {
+		if r := roundTo(tc.v, tc.n); r != tc.expected {
+			t.Errorf("roundTo(%v, %d): expected %v, received %v", tc.v, tc.n, tc.expected, r)
+		}
+	}
+	if r := roundTo(math.Inf(-1), 2); !math.IsInf(r, -1) {
+		t.Errorf("expected -Inf unchanged, received %v", r)
+	}
+}
+
+func TestPushRoundDecimals(t *testing.T) {
+	defer func(n int) { *roundDecimals = n }(*roundDecimals)
+	*roundDecimals = 1
+	*graphitePrefix = ""
+	*statsdPrefix = ""
+	*collectdPrefix = ""
+	ts := time.Unix(1343124840, 0)
+
+	f := metrics.NewMetric("ratio", "prog", metrics.Gauge, metrics.Float)
+	d, _ := f.GetDatum()
+	datum.SetFloat(d, -0.6666, ts)
+	i := metrics.NewMetric("count", "prog", metrics.Counter, metrics.Int)
+	d, _ = i.GetDatum()
+	datum.SetInt(d, 37, ts)
+
+	for _, tc := range []struct {
+		f        formatter
+		expected []string
+	}{
+		{metricToGraphite, []string{"prog.ratio -0.7 1343124840\n", "prog.count 37 1343124840\n"}},
+		{metricToStatsd, []string{"prog.ratio:0|g\nprog.ratio:-0.7|g", "prog.count:37|c"}},
+		{metricToCollectd, []string{"PUTVAL \"gunstar/mtail-prog/gauge-ratio\" interval=60 1343124840:-0.7\n", "PUTVAL \"gunstar/mtail-prog/counter-count\" interval=60 1343124840:37\n"}},
+	} {
+		r := append(FakeSocketWrite(tc.f, f), FakeSocketWrite(tc.f, i)...)
+		if diff := cmp.Diff(tc.expected, r); diff != "" {
+			t.Errorf("rounded values didn't match:\n%s", diff)
+		}
+	}
+	if r := pushValue(datum.MakeFloat(2.25, ts)); r != 2.3 {
+		t.Errorf("expected 2.3, received %v", r)
+	}
+}
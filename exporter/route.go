@@ -0,0 +1,115 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/csv"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+var routeFile = flag.String("metric_push_route_file", "",
+	"Path to a CSV file of routes from metrics to push targets, one per line: a glob matching metric names, the name of a target, and optionally the name transforms to apply for that target, e.g. requests_*,graphite,lowercase,strip_prefix:app_.  A target named in the file is only pushed the metrics that a route selects; other targets are pushed every metric.  Lines starting with # are ignored.")
+
+// routeTargetNames are the names of the push targets that metrics can be
+// routed to.
+var routeTargetNames = map[string]bool{
+	"collectd": true,
+	"graphite": true,
+	"statsd":   true,
+	"fifo":     true,
+	"csv":      true,
+}
+
+// route sends the metrics whose names match a selector to a target, with a
+// transform applied to their names.
+type route struct {
+	selector  string
+	target    string
+	transform nameTransform // May be nil.
+}
+
+// routeTable holds the routes read from the route file, in the order they
+// appear.
+type routeTable struct {
+	routes  []route
+	targets map[string]bool // Targets that appear in a route.
+}
+
+// loadRoutes reads a route file.
+func loadRoutes(path string) (*routeTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRoutes(f)
+}
+
+func readRoutes(r io.Reader) (*routeTable, error) {
+	c := csv.NewReader(r)
+	c.Comment = '#'
+	c.FieldsPerRecord = -1
+	c.TrimLeadingSpace = true
+	t := &routeTable{targets: make(map[string]bool)}
+	for {
+		rec, err := c.Read()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 2 {
+			return nil, errors.Errorf("route %q needs a selector and a target", rec)
+		}
+		if _, err := path.Match(rec[0], ""); err != nil || rec[0] == "" {
+			return nil, errors.Errorf("bad selector %q in route %q", rec[0], rec)
+		}
+		if !routeTargetNames[rec[1]] {
+			return nil, errors.Errorf("unknown target %q in route %q", rec[1], rec)
+		}
+		transform, err := parseNameTransforms(strings.Join(rec[2:], ","))
+		if err != nil {
+			return nil, errors.Wrapf(err, "route %q", rec)
+		}
+		t.routes = append(t.routes, route{rec[0], rec[1], transform})
+		t.targets[rec[1]] = true
+	}
+}
+
+// metric returns the metric to push to the named target in place of m, and
+// whether m is pushed to the target at all.  A target that doesn't appear in
+// the table is pushed every metric unchanged.  Otherwise the first route to
+// the target that selects m decides: if it transforms the name, the returned
+// metric is a copy of m under the new name, that holds no values.  It is safe
+// to call on a nil table.
+func (t *routeTable) metric(m *metrics.Metric, target string) (*metrics.Metric, bool) {
+	if t == nil || !t.targets[target] {
+		return m, true
+	}
+	for _, r := range t.routes {
+		if r.target != target {
+			continue
+		}
+		if ok, _ := path.Match(r.selector, m.Name); !ok {
+			continue
+		}
+		if r.transform == nil {
+			return m, true
+		}
+		name := r.transform(m.Name)
+		if name == m.Name {
+			return m, true
+		}
+		return renamedMetric(m, name), true
+	}
+	return nil, false
+}
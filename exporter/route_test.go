@@ -0,0 +1,79 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestReadRoutes(t *testing.T) {
+	r, err := readRoutes(strings.NewReader("# selector,target,transforms\nrequests_*,graphite,lowercase,strip_prefix:requests_\n*, statsd\n"))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(r.routes) != 2 {
+		t.Fatalf("expected 2 routes, received %d", len(r.routes))
+	}
+	if r.routes[0].transform("requests_OK") != "ok" {
+		t.Errorf("transform not applied: %q", r.routes[0].transform("requests_OK"))
+	}
+	if r.routes[1].transform != nil {
+		t.Errorf("expected no transform for the second route")
+	}
+	for _, in := range []string{"requests\n", "[,graphite\n", ",graphite\n", "a,prometheus\n", "a,graphite,reverse\n"} {
+		if _, err := readRoutes(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestWriteSocketMetricsRoutes(t *testing.T) {
+	defer func(s string) { *graphitePrefix = s }(*graphitePrefix)
+	*graphitePrefix = ""
+
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	for _, name := range []string{"requests_ok", "errors"} {
+		m := metrics.NewMetric(name, "prog", metrics.Counter, metrics.Int)
+		d, _ := m.GetDatum()
+		datum.SetInt(d, 1, ts)
+		ms.Add(m)
+	}
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.routes, err = readRoutes(strings.NewReader("requests_*,graphite,strip_prefix:requests_\nrequests_*,statsd\n*,graphite\n"))
+	if err != nil {
+		t.Fatalf("couldn't read routes: %s", err)
+	}
+
+	for target, expected := range map[string]string{
+		"graphite": "prog.errors 1 1343124840\nprog.ok 1 1343124840\n",
+		"statsd":   "prog.requests_ok 1 1343124840\n",
+		"collectd": "prog.errors 1 1343124840\nprog.requests_ok 1 1343124840\n",
+	} {
+		o := pushOptions{
+			name:    target,
+			f:       metricToGraphite,
+			total:   new(expvar.Int),
+			success: new(expvar.Int),
+		}
+		b := &bytes.Buffer{}
+		if _, err := e.writeSocketMetrics(b, o); err != nil {
+			t.Fatalf("%s: writeSocketMetrics failed: %s", target, err)
+		}
+		if diff := cmp.Diff(expected, b.String()); diff != "" {
+			t.Errorf("%s: lines didn't match:\n%s", target, diff)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/pkg/errors"
+)
+
+var snapshotDir = flag.String("metric_snapshot_dir", os.TempDir(),
+	"Directory that snapshots of the metric store are written to, one newline delimited JSON file per snapshot, when mtail receives SIGUSR1.")
+
+// WriteSnapshot writes every metric in the store to w as newline delimited
+// JSON, one metric per line, in name order.  The store lock is only held
+// while the metrics are listed, and each metric is locked only while it is
+// encoded, so log processing is held up for no more than one metric at a
+// time.
+func (e *Exporter) WriteSnapshot(w io.Writer) error {
+	e.store.RLock()
+	var ms []*metrics.Metric
+	for _, ml := range e.store.Metrics {
+		ms = append(ms, ml...)
+	}
+	e.store.RUnlock()
+	sort.Stable(byNameAndProgram(ms))
+
+	enc := json.NewEncoder(w)
+	for _, m := range ms {
+		m.RLock()
+		err := enc.Encode(m)
+		m.RUnlock()
+		if err != nil {
+			return errors.Wrapf(err, "encoding %s", m.Name)
+		}
+	}
+	return nil
+}
+
+// byNameAndProgram sorts metrics by name, and then by program.
+type byNameAndProgram []*metrics.Metric
+
+func (b byNameAndProgram) Len() int      { return len(b) }
+func (b byNameAndProgram) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byNameAndProgram) Less(i, j int) bool {
+	if b[i].Name != b[j].Name {
+		return b[i].Name < b[j].Name
+	}
+	return b[i].Program < b[j].Program
+}
+
+// Snapshot writes the store to a new file in metric_snapshot_dir named for
+// the time now, and returns the path of the file.  The snapshot is written to
+// a temporary file beside it and renamed once complete, so a failed snapshot
+// leaves no partial file behind.
+func (e *Exporter) Snapshot(now time.Time) (string, error) {
+	path := filepath.Join(*snapshotDir, "mtail-snapshot-"+now.UTC().Format("20060102T150405.000Z")+".ndjson")
+	if _, err := os.Lstat(path); err == nil {
+		return "", errors.Errorf("creating snapshot: %s already exists", path)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", errors.Wrap(err, "creating snapshot")
+	}
+	err = e.WriteSnapshot(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "closing snapshot")
+	}
+	if err == nil {
+		err = errors.Wrap(os.Rename(tmp, path), "renaming snapshot")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer func(s string) { *snapshotDir = s }(*snapshotDir)
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	*snapshotDir = dir
+
+	ms := metrics.NewStore()
+	for _, name := range []string{"requests", "errors"} {
+		m := metrics.NewMetric(name, "prog", metrics.Counter, metrics.Int, "code")
+		d, _ := m.GetDatum("200")
+		datum.SetInt(d, 1, time.Unix(1343124840, 0))
+		ms.Add(m)
+	}
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	now := time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)
+	path, err := e.Snapshot(now)
+	if err != nil {
+		t.Fatalf("snapshot failed: %s", err)
+	}
+	if diff := cmp.Diff(filepath.Join(dir, "mtail-snapshot-20120724T101400.000Z.ndjson"), path); diff != "" {
+		t.Errorf("path didn't match:\n%s", diff)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("couldn't read snapshot: %s", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	var names []string
+	for _, l := range lines {
+		var m struct{ Name string }
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatalf("line %q isn't JSON: %s", l, err)
+		}
+		names = append(names, m.Name)
+	}
+	if diff := cmp.Diff([]string{"errors", "requests"}, names); diff != "" {
+		t.Errorf("metrics didn't match:\n%s", diff)
+	}
+
+	// A second snapshot at the same time doesn't overwrite the first.
+	if _, err := e.Snapshot(now); err == nil {
+		t.Errorf("expected error for an existing snapshot")
+	}
+	var buf bytes.Buffer
+	if err := e.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %s", err)
+	}
+	if diff := cmp.Diff(string(b), buf.String()); diff != "" {
+		t.Errorf("snapshot changed:\n%s", diff)
+	}
+}
+
+func TestSnapshotFailureLeavesNoFile(t *testing.T) {
+	defer func(s string) { *snapshotDir = s }(*snapshotDir)
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	*snapshotDir = dir
+
+	// NaN can't be encoded as JSON, so the snapshot fails part way through.
+	ms := metrics.NewStore()
+	a := metrics.NewMetric("a_ok", "prog", metrics.Gauge, metrics.Float)
+	d, _ := a.GetDatum()
+	datum.SetFloat(d, 1, time.Unix(1343124840, 0))
+	ms.Add(a)
+	b := metrics.NewMetric("b_nan", "prog", metrics.Gauge, metrics.Float)
+	d, _ = b.GetDatum()
+	datum.SetFloat(d, math.NaN(), time.Unix(1343124840, 0))
+	ms.Add(b)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	if _, err := e.Snapshot(time.Date(2012, 7, 24, 10, 14, 0, 0, time.UTC)); err == nil {
+		t.Fatalf("expected snapshot to fail")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("couldn't read dir: %s", err)
+	}
+	for _, f := range files {
+		t.Errorf("unexpected file %s left behind", f.Name())
+	}
+}
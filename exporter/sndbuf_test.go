@@ -0,0 +1,41 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package exporter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetSendBuffer(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("couldn't dial: %s", err)
+	}
+	defer conn.Close()
+	c := conn.(*net.UDPConn)
+
+	if err := setSendBuffer(c, 64*1024); err != nil {
+		t.Fatalf("setSendBuffer failed: %s", err)
+	}
+	size, err := sendBufferSize(c)
+	if err != nil {
+		t.Fatalf("sendBufferSize failed: %s", err)
+	}
+	if size < 64*1024 {
+		t.Errorf("expected a send buffer of at least %d bytes, received %d", 64*1024, size)
+	}
+	// A size beyond the kernel limit is clamped, not an error.
+	if err := setSendBuffer(c, 1<<30); err != nil {
+		t.Errorf("setSendBuffer of a clamped size failed: %s", err)
+	}
+}
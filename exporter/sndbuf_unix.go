@@ -0,0 +1,24 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package exporter
+
+import (
+	"net"
+	"syscall"
+)
+
+// sendBufferSize returns the size of the send buffer of a UDP socket, as
+// reported by the kernel.  The size is read from a duplicate of the socket's
+// file descriptor, which shares the socket and so its send buffer.
+func sendBufferSize(c *net.UDPConn) (int, error) {
+	f, err := c.File()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+}
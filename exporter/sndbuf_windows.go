@@ -0,0 +1,15 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// sendBufferSize is not supported on Windows.
+func sendBufferSize(c *net.UDPConn) (int, error) {
+	return 0, errors.New("reading the socket send buffer size is not supported")
+}
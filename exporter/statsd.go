@@ -7,7 +7,11 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"net"
+	"strings"
+	"sync"
 
+	"github.com/golang/glog"
 	"github.com/google/mtail/metrics"
 )
 
@@ -16,6 +20,16 @@ var (
 		"Host:port to statsd server to write metrics to.")
 	statsdPrefix = flag.String("statsd_prefix", "",
 		"Prefix to use for statsd metrics.")
+	statsdRequireLabel = flag.String("statsd_require_label", "",
+		"If set to a label and value, e.g. safe:true, only series with exactly that label and value are pushed to statsd.  Other series are skipped, and counted in metric_push_label_filtered_total.")
+	statsdExplodeLabel = flag.String("statsd_explode_label", "",
+		"If set to a label name, e.g. code, series with that label are pushed to statsd as one metric per value of the label, with the value appended to the metric name (e.g. requests_200) and the label removed.")
+	statsdUDPSndbuf = flag.Int("statsd_udp_sndbuf", 0,
+		"If not 0, size in bytes of the socket send buffer for pushes to statsd, to avoid losing datagrams when a push is large.  The kernel may limit the size; if so, the limit is logged.")
+	statsdDialTimeout = flag.Duration("statsd_dial_timeout", 0,
+		"Time to wait to connect to statsd on each push.  If 0, metric_push_write_deadline is used.")
+	statsdWriteDeadline = flag.Duration("statsd_write_deadline", 0,
+		"Time to wait for each push to statsd to be written once connected.  If 0, metric_push_write_deadline is used.")
 
 	statsdExportTotal   = expvar.NewInt("statsd_export_total")
 	statsdExportSuccess = expvar.NewInt("statsd_export_success")
@@ -23,6 +37,10 @@ var (
 
 // metricToStatsd encodes a metric in the statsd text protocol format.  The
 // metric lock is held before entering this function.
+//
+// A statsd gauge value with a leading sign is a relative adjustment to the
+// gauge, so a negative gauge is sent as two lines, first setting the gauge to
+// zero and then adjusting it by the negative value.
 func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
 	var t string
 	switch m.Kind {
@@ -33,9 +51,55 @@ func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) str
 	case metrics.Timer:
 		t = "ms" // StatsD Timer
 	}
-	return fmt.Sprintf("%s%s.%s:%s|%s",
+	base, labels := explodeLabel(m.Name, l.Labels, *statsdExplodeLabel)
+	name := truncateName(fmt.Sprintf("%s%s.%s",
 		*statsdPrefix,
 		m.Program,
-		formatLabels(m.Name, l.Labels, ".", ".", "_"),
-		l.Datum.ValueString(), t)
+		formatLabels(base, labels, ".", ".", "_")))
+	value := pushValueString(l.Datum)
+	if m.Kind == metrics.Gauge && strings.HasPrefix(value, "-") {
+		return fmt.Sprintf("%s:0|%s\n%s:%s|%s", name, t, name, value, t)
+	}
+	return fmt.Sprintf("%s:%s|%s",
+		name,
+		value, t)
+}
+
+// explodeLabel folds the value of the label key into the metric name, and
+// returns the name and the remaining labels.  If key is empty or the series
+// doesn't have the label, the name and labels are returned unchanged.
+func explodeLabel(name string, labels map[string]string, key string) (string, map[string]string) {
+	v, ok := labels[key]
+	if key == "" || !ok {
+		return name, labels
+	}
+	rest := make(map[string]string, len(labels)-1)
+	for k, lv := range labels {
+		if k != key {
+			rest[k] = lv
+		}
+	}
+	return name + "_" + strings.Replace(v, ".", "_", -1), rest
+}
+
+var clampedSndbufOnce sync.Once
+
+// setSendBuffer sets the size of the send buffer of a UDP connection, and
+// logs once if the kernel gives it a smaller buffer than requested.
+func setSendBuffer(c *net.UDPConn, size int) error {
+	if err := c.SetWriteBuffer(size); err != nil {
+		return err
+	}
+	actual, err := sendBufferSize(c)
+	if err != nil {
+		glog.V(1).Infof("Couldn't read socket send buffer size: %s", err)
+		return nil
+	}
+	// Linux reports double the requested size, to allow for its own overhead.
+	if actual < size {
+		clampedSndbufOnce.Do(func() {
+			glog.Warningf("Requested a %d byte send buffer for %s, but the kernel limited it to %d bytes", size, c.RemoteAddr(), actual)
+		})
+	}
+	return nil
 }
@@ -0,0 +1,155 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	metricStream = flag.Bool("metric_stream", false,
+		"If true, clients can subscribe to the websocket at /stream to receive the series that changed in each push interval, in the JSON format.")
+
+	streamDropped = expvar.NewInt("metric_stream_dropped_total")
+)
+
+// streamBuffer is the number of updates queued for each subscriber before
+// further updates to it are dropped.
+const streamBuffer = 4
+
+// diffStream sends the series that changed since the previous push to each
+// subscriber.
+type diffStream struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+
+	seen map[string]int64 // Update time of each series in the previous push, in nanoseconds.
+}
+
+func newDiffStream() *diffStream {
+	return &diffStream{subs: make(map[chan []byte]struct{}), seen: make(map[string]int64)}
+}
+
+// subscribe returns a channel that receives each update.
+func (s *diffStream) subscribe() chan []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(chan []byte, streamBuffer)
+	s.subs[c] = struct{}{}
+	return c
+}
+
+func (s *diffStream) unsubscribe(c chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, c)
+}
+
+// diff returns the metrics in the store that have series updated since the
+// previous call, with only the updated series.  A series is updated if the
+// time of its last update is different from the previous call.
+func (s *diffStream) diff(ms *metrics.Store) []*metrics.Metric {
+	seen := make(map[string]int64)
+	changed := make([]*metrics.Metric, 0)
+	ms.RLock()
+	defer ms.RUnlock()
+	for _, ml := range ms.Metrics {
+		for _, m := range ml {
+			if m.Hidden {
+				continue
+			}
+			m.RLock()
+			var lvs []*metrics.LabelValue
+			for _, lv := range m.LabelValues {
+				key := m.Program + "\x00" + m.Name + "\x00" + strings.Join(lv.Labels, "\x00")
+				t := lv.Value.TimeUTC().UnixNano()
+				seen[key] = t
+				if prev, ok := s.seen[key]; !ok || prev != t {
+					lvs = append(lvs, lv)
+				}
+			}
+			if len(lvs) > 0 {
+				changed = append(changed, &metrics.Metric{
+					Name:        m.Name,
+					Program:     m.Program,
+					Kind:        m.Kind,
+					Type:        m.Type,
+					Keys:        m.Keys,
+					LabelValues: lvs,
+				})
+			}
+			m.RUnlock()
+		}
+	}
+	s.seen = seen
+	return changed
+}
+
+// publish sends the series changed since the previous publish to every
+// subscriber.  A subscriber that hasn't received its earlier updates doesn't
+// receive this update, so that a slow subscriber can't hold up the push.
+func (s *diffStream) publish(ms *metrics.Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.diff(ms)
+	if len(s.subs) == 0 || len(changed) == 0 {
+		return
+	}
+	b, err := json.Marshal(changed)
+	if err != nil {
+		glog.Infof("error marshalling metric stream update: %s", err)
+		return
+	}
+	for c := range s.subs {
+		select {
+		case c <- b:
+		default:
+			streamDropped.Add(1)
+		}
+	}
+}
+
+// HandleStream serves the websocket of changed series, if the metric stream
+// is enabled.
+func (e *Exporter) HandleStream(w http.ResponseWriter, r *http.Request) {
+	if e.stream == nil {
+		http.Error(w, "metric stream not enabled, start mtail with --metric_stream", http.StatusNotFound)
+		return
+	}
+	websocket.Handler(e.streamTo).ServeHTTP(w, r)
+}
+
+// streamTo sends updates to a websocket client until it disconnects.
+func (e *Exporter) streamTo(ws *websocket.Conn) {
+	c := e.stream.subscribe()
+	defer e.stream.unsubscribe(c)
+	// The client never sends anything; the read fails when it disconnects.
+	closed := make(chan struct{})
+	go func() {
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+		close(closed)
+	}()
+	for {
+		select {
+		case b := <-c:
+			if err := websocket.Message.Send(ws, string(b)); err != nil {
+				glog.V(1).Infof("metric stream send failed: %s", err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+	"golang.org/x/net/websocket"
+)
+
+// streamedSeries decodes an update into the set of series it contains.
+func streamedSeries(t *testing.T, b []byte) map[string]bool {
+	var ms []*metrics.Metric
+	if err := json.Unmarshal(b, &ms); err != nil {
+		t.Fatalf("couldn't decode update %q: %s", b, err)
+	}
+	r := make(map[string]bool)
+	for _, m := range ms {
+		for _, lv := range m.LabelValues {
+			r[m.Name+"{"+strings.Join(lv.Labels, ",")+"}"] = true
+		}
+	}
+	return r
+}
+
+func TestDiffStream(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("requests", "prog", metrics.Counter, metrics.Int, "code")
+	d200, _ := m.GetDatum("200")
+	datum.SetInt(d200, 1, ts)
+	d500, _ := m.GetDatum("500")
+	datum.SetInt(d500, 1, ts)
+	ms.Add(m)
+
+	s := newDiffStream()
+	c := s.subscribe()
+	s.publish(ms)
+	if r := streamedSeries(t, <-c); len(r) != 2 {
+		t.Errorf("expected all series in first update, received %v", r)
+	}
+
+	// No changes, no update.
+	s.publish(ms)
+	select {
+	case b := <-c:
+		t.Errorf("unexpected update %s", b)
+	default:
+	}
+
+	datum.IncIntBy(d500, 1, ts.Add(time.Second))
+	s.publish(ms)
+	r := streamedSeries(t, <-c)
+	if len(r) != 1 || !r["requests{500}"] {
+		t.Errorf("expected only the changed series, received %v", r)
+	}
+
+	// A subscriber that doesn't read has updates dropped.
+	dropped := streamDropped.Value()
+	for i := 0; i < streamBuffer+2; i++ {
+		datum.IncIntBy(d200, 1, ts.Add(time.Duration(i+2)*time.Second))
+		s.publish(ms)
+	}
+	if r := streamDropped.Value() - dropped; r != 2 {
+		t.Errorf("expected 2 updates dropped, received %d", r)
+	}
+}
+
+func TestHandleStream(t *testing.T) {
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge, metrics.Int)
+	m.GetDatum()
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.stream = newDiffStream()
+	srv := httptest.NewServer(websocket.Handler(e.streamTo))
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", srv.URL)
+	if err != nil {
+		t.Fatalf("couldn't connect to stream: %s", err)
+	}
+	defer ws.Close()
+	// Wait for the handler to subscribe.
+	for {
+		e.stream.mu.Lock()
+		n := len(e.stream.subs)
+		e.stream.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	e.stream.publish(ms)
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("couldn't receive update: %s", err)
+	}
+	if r := streamedSeries(t, []byte(msg)); !r["foo{}"] {
+		t.Errorf("expected foo in update, received %v", r)
+	}
+}
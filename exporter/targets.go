@@ -0,0 +1,55 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"time"
+
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+const targetHealthName = "mtail_export_targets"
+
+var (
+	emitTargetHealth = flag.Bool("emit_target_health", false,
+		"Export the gauge "+targetHealthName+", the number of push targets in each state, up or down, computed at each push as for /healthz.")
+)
+
+// newTargetHealth creates the target health metric and adds it to the store.
+func newTargetHealth(ms *metrics.Store) (*metrics.Metric, error) {
+	m := metrics.NewMetric(targetHealthName, "mtail", metrics.Gauge, metrics.Int, "state")
+	m.Public = true
+	if err := ms.Add(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// updateTargetHealth counts the push targets that are up and down, from the
+// time each last succeeded, and sets the values of the target health metric
+// to the counts.  Both states are always present, so a fleet can be summed
+// without gaps; with no push targets, both are 0.
+func (e *Exporter) updateTargetHealth(now time.Time) {
+	if e.targetHealth == nil {
+		return
+	}
+	_, status := e.healthy(now)
+	counts := map[string]int64{"up": 0, "down": 0}
+	for _, up := range status {
+		if up {
+			counts["up"]++
+		} else {
+			counts["down"]++
+		}
+	}
+	for _, state := range []string{"up", "down"} {
+		d, err := e.targetHealth.GetDatum(state)
+		if err != nil {
+			continue
+		}
+		datum.SetInt(d, counts[state], now)
+	}
+}
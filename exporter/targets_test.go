@@ -0,0 +1,93 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestUpdateTargetHealth(t *testing.T) {
+	defer func(b bool) { *emitTargetHealth = b }(*emitTargetHealth)
+	*emitTargetHealth = true
+
+	ms := metrics.NewStore()
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	counts := func() map[string]string {
+		r := make(map[string]string)
+		lc := make(chan *metrics.LabelSet)
+		go e.targetHealth.EmitLabelSets(lc)
+		for l := range lc {
+			r[l.Labels["state"]] = l.Datum.ValueString()
+		}
+		return r
+	}
+
+	now := time.Now()
+	e.updateTargetHealth(now)
+	if diff := cmp.Diff(map[string]string{"up": "0", "down": "0"}, counts()); diff != "" {
+		t.Errorf("counts without targets didn't match:\n%s", diff)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		e.RegisterPushExport(pushOptions{name: name})
+	}
+	e.lastSuccess["a"] = now
+	e.lastSuccess["b"] = now.Add(-time.Hour)
+	e.updateTargetHealth(now)
+	if diff := cmp.Diff(map[string]string{"up": "1", "down": "2"}, counts()); diff != "" {
+		t.Errorf("counts didn't match:\n%s", diff)
+	}
+	if len(ms.Metrics[targetHealthName]) != 1 {
+		t.Errorf("expected target health metric in the store")
+	}
+}
+
+func TestPushMetricsClientTargetHealth(t *testing.T) {
+	fail := true
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, metrics.Int)
+	d, _ := m.GetDatum()
+	datum.SetInt(d, 1, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.influx, err = newInfluxClient(s.URL, "org", "bucket", "")
+	if err != nil {
+		t.Fatalf("couldn't make client: %s", err)
+	}
+	if diff := cmp.Diff([]string{influxTargetName}, e.targetNames()); diff != "" {
+		t.Errorf("target names didn't match:\n%s", diff)
+	}
+
+	e.PushMetrics()
+	if _, status := e.healthy(time.Now()); status[influxTargetName] {
+		t.Errorf("expected %s down after a failed push", influxTargetName)
+	}
+	fail = false
+	e.PushMetrics()
+	if _, status := e.healthy(time.Now()); !status[influxTargetName] {
+		t.Errorf("expected %s up after a successful push", influxTargetName)
+	}
+}
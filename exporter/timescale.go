@@ -0,0 +1,142 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const timescaleTargetName = "timescale"
+
+var (
+	timescaleDSN = flag.String("timescale_dsn", "",
+		"Connection string of a TimescaleDB or PostgreSQL database to write metrics to.")
+	timescaleTable = flag.String("timescale_table", "mtail_metrics",
+		"Table to insert metrics into.  It must have the columns time, name, labels (jsonb), and value.")
+
+	timescaleExportTotal   = expvar.NewInt("timescale_export_total")
+	timescaleExportSuccess = expvar.NewInt("timescale_export_success")
+)
+
+// openTimescale prepares a connection pool for the database named by dsn.  No
+// connection is made until the first push.
+func openTimescale(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening timescale database")
+	}
+	return db, nil
+}
+
+// metricToTimescale returns the column values of the row describing a single
+// LabelSet of a metric.  The metric lock is held before entering this
+// function.
+func metricToTimescale(o Options, m *metrics.Metric, l *metrics.LabelSet) (time.Time, string, string, string, error) {
+	labels := make(map[string]string, len(l.Labels)+1)
+	for k, v := range l.Labels {
+		labels[k] = v
+	}
+	if !o.OmitProgLabel {
+		labels["prog"] = m.Program
+	}
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return time.Time{}, "", "", "", err
+	}
+	return pushTime(o.Hostname, l), m.Name, string(b), pushValueString(l.Datum), nil
+}
+
+// writeTimescaleMetrics inserts a row for every LabelSet in the store into the
+// timescale table, with a single COPY inside a transaction.  Rows are only
+// counted as successfully exported once the transaction commits.
+//
+// Connections that have been dropped by the server are discarded by the
+// connection pool, and a new connection is made on the next push.
+func (e *Exporter) writeTimescaleMetrics() error {
+	txn, err := e.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	stmt, err := txn.Prepare(pq.CopyIn(*timescaleTable, "time", "name", "labels", "value"))
+	if err != nil {
+		txn.Rollback()
+		return errors.Wrap(err, "preparing copy")
+	}
+
+	rows, err := e.copyTimescaleRows(stmt)
+	if err != nil {
+		stmt.Close()
+		txn.Rollback()
+		return err
+	}
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		txn.Rollback()
+		return errors.Wrap(err, "flushing copy")
+	}
+	if err = stmt.Close(); err != nil {
+		txn.Rollback()
+		return errors.Wrap(err, "closing copy")
+	}
+	if err = txn.Commit(); err != nil {
+		return errors.Wrap(err, "committing")
+	}
+	timescaleExportSuccess.Add(int64(rows))
+	glog.V(2).Infof("Inserted %d rows", rows)
+	return nil
+}
+
+// copyTimescaleRows sends each LabelSet in the store to the COPY statement,
+// and returns the number of rows sent.
+func (e *Exporter) copyTimescaleRows(stmt *sql.Stmt) (int, error) {
+	e.store.RLock()
+	defer e.store.RUnlock()
+
+	rows := 0
+	now := time.Now()
+	for _, ml := range e.store.Metrics {
+		for _, m := range ml {
+			if !e.pushes(m, timescaleTargetName) {
+				continue
+			}
+			m.RLock()
+			timescaleExportTotal.Add(1)
+			lc := make(chan *metrics.LabelSet)
+			go e.emitLabelSets(m, lc)
+			var err error
+			for l := range lc {
+				if err != nil {
+					continue
+				}
+				if tooOld(l, now) {
+					e.dropped.add(dropBackfill, timescaleTargetName, 1)
+					continue
+				}
+				var ts time.Time
+				var name, labels, value string
+				ts, name, labels, value, err = metricToTimescale(e.o, m, l)
+				if err == nil {
+					_, err = stmt.Exec(ts, name, labels, value)
+				}
+				if err == nil {
+					rows++
+				}
+			}
+			m.RUnlock()
+			if err != nil {
+				return rows, errors.Wrapf(err, "copying %s", m.Name)
+			}
+		}
+	}
+	return rows, nil
+}
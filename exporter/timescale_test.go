@@ -0,0 +1,45 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
+)
+
+func TestMetricToTimescale(t *testing.T) {
+	ts := time.Unix(1343124840, 0).UTC()
+	m := metrics.NewMetric("bar", "prog", metrics.Gauge, metrics.Int, "b", "a")
+	d, _ := m.GetDatum("2", "1")
+	datum.SetInt(d, 37, ts)
+
+	lc := make(chan *metrics.LabelSet)
+	go m.EmitLabelSets(lc)
+	l := <-lc
+	for range lc {
+	}
+
+	for _, tc := range []struct {
+		o      Options
+		labels string
+	}{
+		{Options{}, `{"a":"1","b":"2","prog":"prog"}`},
+		{Options{OmitProgLabel: true}, `{"a":"1","b":"2"}`},
+	} {
+		rts, name, labels, value, err := metricToTimescale(tc.o, m, l)
+		if err != nil {
+			t.Fatalf("metricToTimescale failed: %s", err)
+		}
+		if !rts.Equal(ts) {
+			t.Errorf("time: expected %s, received %s", ts, rts)
+		}
+		if diff := cmp.Diff([]string{"bar", tc.labels, "37"}, []string{name, labels, value}); diff != "" {
+			t.Errorf("row didn't match:\n%s", diff)
+		}
+	}
+}
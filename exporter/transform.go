@@ -0,0 +1,68 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nameTransform rewrites a metric name before it is pushed to a target.
+type nameTransform func(string) string
+
+// nameTransforms maps the name of each transform to a function that returns
+// the transform for an argument.  Transforms that don't take an argument
+// ignore it.
+var nameTransforms = map[string]struct {
+	hasArg bool
+	f      func(arg string) nameTransform
+}{
+	"lowercase": {false, func(string) nameTransform { return strings.ToLower }},
+	"dot_to_underscore": {false, func(string) nameTransform {
+		return func(s string) string { return strings.Replace(s, ".", "_", -1) }
+	}},
+	"dash_to_underscore": {false, func(string) nameTransform {
+		return func(s string) string { return strings.Replace(s, "-", "_", -1) }
+	}},
+	"strip_prefix": {true, func(arg string) nameTransform {
+		return func(s string) string { return strings.TrimPrefix(s, arg) }
+	}},
+	"strip_suffix": {true, func(arg string) nameTransform {
+		return func(s string) string { return strings.TrimSuffix(s, arg) }
+	}},
+}
+
+// parseNameTransforms parses a comma separated list of transforms, such as
+// "lowercase,strip_prefix:app_", into a single transform that applies each in
+// order.  An empty list returns nil.
+func parseNameTransforms(spec string) (nameTransform, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var ts []nameTransform
+	for _, item := range strings.Split(spec, ",") {
+		name, arg := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			name, arg = item[:i], item[i+1:]
+		}
+		t, ok := nameTransforms[name]
+		if !ok {
+			return nil, errors.Errorf("unknown name transform %q", name)
+		}
+		if t.hasArg != (arg != "") {
+			if t.hasArg {
+				return nil, errors.Errorf("name transform %q needs an argument, e.g. %s:value", name, name)
+			}
+			return nil, errors.Errorf("name transform %q takes no argument", name)
+		}
+		ts = append(ts, t.f(arg))
+	}
+	return func(s string) string {
+		for _, t := range ts {
+			s = t(s)
+		}
+		return s
+	}, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import "testing"
+
+func TestParseNameTransforms(t *testing.T) {
+	for _, tc := range []struct {
+		spec, name, expected string
+	}{
+		{"lowercase", "Foo.Bar", "foo.bar"},
+		{"dot_to_underscore", "foo.bar", "foo_bar"},
+		{"dash_to_underscore", "foo-bar", "foo_bar"},
+		{"strip_prefix:app_", "app_requests", "requests"},
+		{"strip_suffix:_total", "requests_total", "requests"},
+		{"lowercase,dot_to_underscore,strip_prefix:app_", "App.Requests", "requests"},
+		// Transforms are applied in order, so the prefix no longer matches.
+		{"strip_prefix:app_,lowercase", "App_requests", "app_requests"},
+	} {
+		f, err := parseNameTransforms(tc.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", tc.spec, err)
+			continue
+		}
+		if r := f(tc.name); r != tc.expected {
+			t.Errorf("%q: transform of %q expected %q, received %q", tc.spec, tc.name, tc.expected, r)
+		}
+	}
+
+	if f, err := parseNameTransforms(""); f != nil || err != nil {
+		t.Errorf("expected no transform for empty list, received %v, %v", f, err)
+	}
+	for _, spec := range []string{"uppercase", "lowercase,", "strip_prefix", "lowercase:foo"} {
+		if _, err := parseNameTransforms(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
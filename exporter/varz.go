@@ -21,6 +21,7 @@ const varzFormat = "%s{%s} %s\n"
 
 // HandleVarz exports the metrics in Varz format via HTTP.
 func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
+	e.updateLabelCardinality()
 	e.store.RLock()
 	defer e.store.RUnlock()
 
@@ -31,7 +32,7 @@ func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
 			m.RLock()
 			exportVarzTotal.Add(1)
 			lc := make(chan *metrics.LabelSet)
-			go m.EmitLabelSets(lc)
+			go e.emitLabelSets(m, lc)
 			for l := range lc {
 				line := metricToVarz(e.o, m, l)
 				fmt.Fprint(w, line)
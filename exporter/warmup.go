@@ -0,0 +1,37 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"flag"
+	"net"
+
+	"github.com/golang/glog"
+)
+
+var warmupConns = flag.Bool("metric_push_warmup", false,
+	"If true, dial each push target once when metric push starts, before the first push, so that name lookups and connection failures are found early.  Failures are logged and don't stop mtail from starting.")
+
+// warmup dials each push target that is reached over the network, and
+// returns the number of targets that couldn't be reached.  Targets opened
+// some other way, like the fifo, are skipped.
+func (e *Exporter) warmup() int {
+	failed := 0
+	for _, target := range e.pushTargets {
+		if target.open != nil {
+			continue
+		}
+		conn, err := net.DialTimeout(target.net, target.addr, target.dialTimeout())
+		if err != nil {
+			glog.Warningf("Warmup of push target %s at %s failed: %s", target.name, target.addr, err)
+			failed++
+			continue
+		}
+		if err := conn.Close(); err != nil {
+			glog.Infof("connection close failed: %s", err)
+		}
+		glog.Infof("Warmed up push target %s at %s", target.name, target.addr)
+	}
+	return failed
+}
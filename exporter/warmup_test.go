@@ -0,0 +1,39 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/mtail/metrics"
+)
+
+func TestWarmup(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+	// Find a port with nothing listening on it.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	e, err := New(Options{Store: metrics.NewStore(), Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.pushTargets = []pushOptions{
+		{name: "up", net: "tcp", addr: l.Addr().String()},
+		{name: "down", net: "tcp", addr: closedAddr},
+		{name: "fifo", open: openFIFO},
+	}
+	if n := e.warmup(); n != 1 {
+		t.Errorf("expected 1 target to fail warmup, received %d", n)
+	}
+}
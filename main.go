@@ -69,6 +69,7 @@ var (
 	syslogUseCurrentYear = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
 	overrideTimezone     = flag.String("override_timezone", "", "If set, use the provided timezone in timestamp conversion, instead of the local zone.")
 	emitProgLabel        = flag.Bool("emit_prog_label", true, "Emit the 'prog' label in variable exports.")
+	emitProgHealth       = flag.Bool("emit_prog_health", false, "Export the metrics mtail_prog_loaded and mtail_prog_runtime_errors for each program.")
 
 	// Debugging flags
 	blockProfileRate     = flag.Int("block_profile_rate", 0, "Nanoseconds of block time before goroutine blocking events reported. 0 turns off.  See https://golang.org/pkg/runtime/#SetBlockProfileRate")
@@ -135,6 +136,7 @@ func main() {
 		SyslogUseCurrentYear: *syslogUseCurrentYear,
 		OverrideLocation:     loc,
 		OmitProgLabel:        !*emitProgLabel,
+		EmitProgHealth:       *emitProgHealth,
 		BuildInfo:            buildInfo(),
 	}
 	m, err := mtail.New(o)
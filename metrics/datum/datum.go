@@ -34,6 +34,9 @@ type Datum interface {
 	ValueString() string
 
 	TimeString() string
+
+	// TimeUTC returns the time the Datum was last updated.
+	TimeUTC() time.Time
 }
 
 type BaseDatum struct {
@@ -54,6 +57,10 @@ func (d *BaseDatum) TimeString() string {
 	return fmt.Sprintf("%d", atomic.LoadInt64(&d.Time)/1e9)
 }
 
+func (d *BaseDatum) TimeUTC() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&d.Time)).UTC()
+}
+
 func NewInt() Datum {
 	return MakeInt(0, zeroTime)
 }
@@ -22,6 +22,9 @@ func TestDatumSetAndValue(t *testing.T) {
 	if r := d.TimeString(); r != "37" {
 		t.Errorf("d Time not correct, got %v", r)
 	}
+	if r := d.TimeUTC(); !r.Equal(time.Unix(37, 42)) {
+		t.Errorf("d Time not correct, got %v", r)
+	}
 	d = MakeFloat(1.2, time.Unix(37, 42))
 	if r := GetFloat(d); r != 1.2 {
 		t.Errorf("d ditn't return 12, got %v", r)
@@ -74,14 +74,18 @@ func (lv *LabelValue) String() string {
 // labels in each dimension of the Keys.
 type Metric struct {
 	sync.RWMutex
-	Name        string // Name
-	Program     string // Instantiating program
-	Kind        Kind
-	Type        datum.Type
-	Hidden      bool          `json:",omitempty"`
-	Keys        []string      `json:",omitempty"`
-	LabelValues []*LabelValue `json:",omitempty"`
-	Source      string        `json:"-"`
+	Name             string // Name
+	Program          string // Instantiating program
+	Kind             Kind
+	Type             datum.Type
+	Hidden           bool          `json:",omitempty"`
+	ExportEvery      int64         `json:",omitempty"` // Pushed on every Nth push, if more than 1.
+	ResetAfterExport bool          `json:",omitempty"` // Series are removed after each push.
+	Public           bool          `json:",omitempty"` // Pushed when only public metrics are pushed.
+	ExportTo         []string      `json:",omitempty"` // Names of the targets exported to; all targets if empty.
+	Keys             []string      `json:",omitempty"`
+	LabelValues      []*LabelValue `json:",omitempty"`
+	Source           string        `json:"-"`
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -83,6 +83,7 @@ func (m *MtailServer) InitLoader() error {
 		SyslogUseCurrentYear: m.o.SyslogUseCurrentYear,
 		OverrideLocation:     m.o.OverrideLocation,
 		OmitMetricSource:     m.o.OmitMetricSource,
+		EmitProgHealth:       m.o.EmitProgHealth,
 		W:                    m.o.W,
 		FS:                   m.o.FS,
 	}
@@ -109,6 +110,7 @@ const statusTemplate = `
 <h1>mtail on {{.BindAddress}}</h1>
 <p>Build: {{.BuildInfo}}</p>
 <p>Metrics: <a href="/json">json</a>, <a href="/metrics">prometheus</a>, <a href="/varz">varz</a></p>
+<p>Health: <a href="/healthz">healthz</a></p>
 <p>Debug: <a href="/debug/pprof">debug/pprof</a>, <a href="/debug/vars">debug/vars</a></p>
 `
 
@@ -156,6 +158,7 @@ type Options struct {
 	OverrideLocation     *time.Location
 	OmitMetricSource     bool
 	OmitProgLabel        bool
+	EmitProgHealth       bool
 
 	BuildInfo string
 
@@ -219,8 +222,13 @@ func (m *MtailServer) Serve() {
 	http.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
 	http.HandleFunc("/metrics", http.HandlerFunc(m.e.HandlePrometheusMetrics))
 	http.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
+	http.HandleFunc("/healthz", http.HandlerFunc(m.e.HandleHealthz))
+	http.HandleFunc("/stream", http.HandlerFunc(m.e.HandleStream))
+	http.HandleFunc("/maintenance", http.HandlerFunc(m.e.HandleMaintenance))
+	http.HandleFunc("/baseline", http.HandlerFunc(m.e.HandleBaseline))
 	http.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
 	m.e.StartMetricPush()
+	go m.handleSnapshotSignals()
 
 	go func() {
 		glog.Infof("Listening on port %s", m.o.BindAddress)
@@ -0,0 +1,31 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package mtail
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// handleSnapshotSignals writes a snapshot of the metric store each time mtail
+// receives SIGUSR1.
+func (m *MtailServer) handleSnapshotSignals() {
+	n := make(chan os.Signal, 1)
+	signal.Notify(n, syscall.SIGUSR1)
+	for range n {
+		path, err := m.e.Snapshot(time.Now())
+		if err != nil {
+			glog.Warningf("Couldn't write snapshot: %s", err)
+			continue
+		}
+		glog.Infof("Received SIGUSR1, wrote snapshot to %s", path)
+	}
+}
@@ -0,0 +1,7 @@
+// Copyright 2018 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+// handleSnapshotSignals does nothing, as there is no SIGUSR1 on Windows.
+func (m *MtailServer) handleSnapshotSignals() {}
@@ -193,13 +193,17 @@ func (n *indexedExprNode) SetType(t Type) {
 }
 
 type declNode struct {
-	pos          position
-	name         string
-	hidden       bool
-	keys         []string
-	kind         metrics.Kind
-	exportedName string
-	sym          *Symbol
+	pos              position
+	name             string
+	hidden           bool
+	keys             []string
+	kind             metrics.Kind
+	exportedName     string
+	exportEvery      int64 // Export on every Nth push; 0 if not set.
+	resetAfterExport bool
+	public           bool     // Pushed to external targets when metric_push_public_only is set.
+	exportTo         []string // Names of the targets to export to; all targets if empty.
+	sym              *Symbol
 }
 
 func (n *declNode) Pos() *position {
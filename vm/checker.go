@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
 )
 
 // checker holds data for a semantic checker
@@ -67,6 +68,12 @@ func (c *checker) VisitBefore(node astNode) Visitor {
 			c.errors.Add(n.Pos(), fmt.Sprintf("Redeclaration of metric `%s' previously declared at %s", n.name, alt.Pos))
 			return nil
 		}
+		if n.public && n.hidden {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Hidden metrics are never exported, so `%s' can't be public", n.name))
+		}
+		if n.resetAfterExport && n.kind != metrics.Gauge {
+			c.errors.Add(n.Pos(), fmt.Sprintf("Only gauges can be reset after export, but `%s' is a %s", n.name, strings.ToLower(n.kind.String())))
+		}
 		if len(n.keys) > 0 {
 			// One type per key and one for the value.
 			keyTypes := make([]Type, 0, len(n.keys)+1)
@@ -52,6 +52,14 @@ var checkerInvalidPrograms = []struct {
 		[]string{"duplicate declaration:2:9-11: Redeclaration of metric `foo' previously declared at duplicate declaration:1:9-11",
 			"duplicate declaration:1:9-11: Declaration of variable `foo' is never used"}},
 
+	{"hidden public metric",
+		"hidden counter foo public\n/x/ {\n  foo++\n}\n",
+		[]string{"hidden public metric:1:16-18: Hidden metrics are never exported, so `foo' can't be public"}},
+
+	{"reset counter after export",
+		"counter foo reset_after_export\n/x/ {\n  foo++\n}\n",
+		[]string{"reset counter after export:1:9-11: Only gauges can be reset after export, but `foo' is a counter"}},
+
 	{"indexedExpr parameter count",
 		`counter n
     counter foo by a, b
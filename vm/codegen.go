@@ -108,6 +108,10 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 			}
 		}
 		m.Hidden = n.hidden
+		m.ExportEvery = n.exportEvery
+		m.ResetAfterExport = n.resetAfterExport
+		m.Public = n.public
+		m.ExportTo = n.exportTo
 		(*n.sym).Binding = m
 		n.sym.Addr = len(c.obj.m)
 		c.obj.m = append(c.obj.m, m)
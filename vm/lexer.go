@@ -67,6 +67,10 @@ var lexemeName = map[lexeme]string{
 	OTHERWISE:    "OTHERWISE",
 	ELSE:         "ELSE",
 	DEL:          "DEL",
+	EVERY:        "EVERY",
+	RESET:        "RESET",
+	PUBLIC:       "PUBLIC",
+	EXPORT_TO:    "EXPORT_TO",
 	INTLITERAL:   "INTLITERAL",
 	FLOATLITERAL: "FLOATLITERAL",
 	NL:           "NL",
@@ -84,18 +88,22 @@ func (t lexeme) String() string {
 
 // List of keywords.  Keep this list sorted!
 var keywords = map[string]lexeme{
-	"as":        AS,
-	"by":        BY,
-	"const":     CONST,
-	"counter":   COUNTER,
-	"def":       DEF,
-	"del":       DEL,
-	"else":      ELSE,
-	"gauge":     GAUGE,
-	"hidden":    HIDDEN,
-	"next":      NEXT,
-	"otherwise": OTHERWISE,
-	"timer":     TIMER,
+	"as":                 AS,
+	"by":                 BY,
+	"const":              CONST,
+	"counter":            COUNTER,
+	"def":                DEF,
+	"del":                DEL,
+	"else":               ELSE,
+	"every":              EVERY,
+	"export_to":          EXPORT_TO,
+	"gauge":              GAUGE,
+	"hidden":             HIDDEN,
+	"next":               NEXT,
+	"otherwise":          OTHERWISE,
+	"public":             PUBLIC,
+	"reset_after_export": RESET,
+	"timer":              TIMER,
 }
 
 // List of builtin functions.  Keep this list sorted!
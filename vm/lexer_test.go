@@ -65,7 +65,7 @@ var lexerTests = []lexerTest{
 		{NOT_MATCH, "!~", position{"operators", 0, 60, 61}},
 		{EOF, "", position{"operators", 0, 62, 62}}}},
 	{"keywords",
-		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\n", []token{
+		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\notherwise\nelse\ndel\nevery\nreset_after_export\npublic\nexport_to\n", []token{
 			{COUNTER, "counter", position{"keywords", 0, 0, 6}},
 			{NL, "\n", position{"keywords", 1, 7, -1}},
 			{GAUGE, "gauge", position{"keywords", 1, 0, 4}},
@@ -90,7 +90,15 @@ var lexerTests = []lexerTest{
 			{NL, "\n", position{"keywords", 11, 4, -1}},
 			{DEL, "del", position{"keywords", 11, 0, 2}},
 			{NL, "\n", position{"keywords", 12, 3, -1}},
-			{EOF, "", position{"keywords", 12, 0, 0}}}},
+			{EVERY, "every", position{"keywords", 12, 0, 4}},
+			{NL, "\n", position{"keywords", 13, 5, -1}},
+			{RESET, "reset_after_export", position{"keywords", 13, 0, 17}},
+			{NL, "\n", position{"keywords", 14, 18, -1}},
+			{PUBLIC, "public", position{"keywords", 14, 0, 5}},
+			{NL, "\n", position{"keywords", 15, 6, -1}},
+			{EXPORT_TO, "export_to", position{"keywords", 15, 0, 8}},
+			{NL, "\n", position{"keywords", 16, 9, -1}},
+			{EOF, "", position{"keywords", 16, 0, 0}}}},
 	{"builtins",
 		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\nint\nbool\nfloat\nstring\n", []token{
 			{BUILTIN, "strptime", position{"builtins", 0, 0, 7}},
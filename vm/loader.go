@@ -26,6 +26,7 @@ import (
 	"github.com/spf13/afero"
 
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 	"github.com/google/mtail/tailer"
 	"github.com/google/mtail/watcher"
 )
@@ -172,10 +173,12 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	v, errs := Compile(name, input, o)
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
+		l.setProgLoaded(name, false)
 		return errors.Errorf("compile failed for %s:\n%s", name, errs)
 	}
 	if v == nil {
 		ProgLoadErrors.Add(name, 1)
+		l.setProgLoaded(name, false)
 		return errors.Errorf("Internal error: Compilation failed for %s: No program returned, but no errors.", name)
 	}
 
@@ -191,6 +194,8 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 			}
 			err := l.ms.Add(m)
 			if err != nil {
+				ProgLoadErrors.Add(name, 1)
+				l.setProgLoaded(name, false)
 				return err
 			}
 		}
@@ -198,6 +203,9 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 
 	ProgLoads.Add(name, 1)
 	glog.Infof("Loaded program %s", name)
+	if h := l.progHealth(name); h != nil {
+		v.runtimeErrors = h.runtimeErrors
+	}
 
 	if l.compileOnly {
 		return nil
@@ -221,6 +229,7 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 	go v.Run(nameCode, l.handles[name].lines, l.handles[name].done, started)
 	<-started
 	glog.Infof("Started %s", name)
+	l.setProgLoaded(name, true)
 
 	return nil
 }
@@ -255,6 +264,10 @@ type Loader struct {
 	dumpBytecode         bool           // Instructs the loader to dump to stdout the compiled program after compilation.
 	syslogUseCurrentYear bool           // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
 	omitMetricSource     bool
+	emitProgHealth       bool // Add metrics reporting the health of each program to the store.
+
+	healthMu sync.Mutex             // guards health
+	health   map[string]*progHealth // health metrics for each program, by name
 }
 
 // LoaderOptions contains the required and optional parameters for creating a
@@ -274,6 +287,7 @@ type LoaderOptions struct {
 	DumpBytecode         bool           // Instructs the loader to dump the program bytecode after compilation.
 	SyslogUseCurrentYear bool           // If true, override empty year with the current in strptime().
 	OmitMetricSource     bool           // Don't put the source in the metric when added to the Store.
+	EmitProgHealth       bool           // Add metrics reporting the health of each program to the Store.
 }
 
 // NewLoader creates a new program loader.  It takes a filesystem watcher
@@ -312,6 +326,8 @@ func NewLoader(o LoaderOptions) (*Loader, error) {
 		syslogUseCurrentYear: o.SyslogUseCurrentYear,
 		overrideLocation:     o.OverrideLocation,
 		omitMetricSource:     o.OmitMetricSource,
+		emitProgHealth:       o.EmitProgHealth,
+		health:               make(map[string]*progHealth),
 	}
 
 	eventsChan := l.w.Events()
@@ -384,6 +400,7 @@ func (l *Loader) UnloadProgram(pathname string) {
 		glog.Infof("Remove watch on %s failed: %s", pathname, err)
 	}
 	name := filepath.Base(pathname)
+	l.setProgLoaded(name, false)
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
 	if handle, ok := l.handles[name]; ok {
@@ -392,3 +409,51 @@ func (l *Loader) UnloadProgram(pathname string) {
 		delete(l.handles, name)
 	}
 }
+
+// progHealth holds the data of the metrics that report the health of a
+// program.  The metrics are in the store under the program's name, so they
+// are exported with the program label.
+type progHealth struct {
+	loaded        datum.Datum // 1 if the program last compiled successfully and is running, 0 otherwise.
+	runtimeErrors datum.Datum // Count of runtime errors in the program.
+}
+
+// progHealth returns the health metrics of the named program, creating them
+// in the store on first use.  It returns nil if the loader isn't emitting
+// program health.
+func (l *Loader) progHealth(name string) *progHealth {
+	if !l.emitProgHealth {
+		return nil
+	}
+	l.healthMu.Lock()
+	defer l.healthMu.Unlock()
+	if h, ok := l.health[name]; ok {
+		return h
+	}
+	loaded := metrics.NewMetric("mtail_prog_loaded", name, metrics.Gauge, metrics.Int)
+	errs := metrics.NewMetric("mtail_prog_runtime_errors", name, metrics.Counter, metrics.Int)
+	h := &progHealth{}
+	h.loaded, _ = loaded.GetDatum()
+	h.runtimeErrors, _ = errs.GetDatum()
+	datum.SetInt(h.runtimeErrors, 0, time.Now())
+	for _, m := range []*metrics.Metric{loaded, errs} {
+		if err := l.ms.Add(m); err != nil {
+			glog.Infof("Couldn't add health metric for %s: %s", name, err)
+		}
+	}
+	l.health[name] = h
+	return h
+}
+
+// setProgLoaded records whether the named program is loaded.
+func (l *Loader) setProgLoaded(name string, loaded bool) {
+	h := l.progHealth(name)
+	if h == nil {
+		return
+	}
+	var v int64
+	if loaded {
+		v = 1
+	}
+	datum.SetInt(h.loaded, v, time.Now())
+}
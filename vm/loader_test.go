@@ -6,9 +6,11 @@ package vm
 import (
 	"strings"
 	"testing"
+	"time"
 
 	go_cmp "github.com/google/go-cmp/cmp"
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/metrics/datum"
 	"github.com/google/mtail/tailer"
 	"github.com/google/mtail/watcher"
 	"github.com/spf13/afero"
@@ -19,7 +21,7 @@ func TestNewLoader(t *testing.T) {
 	store := metrics.NewStore()
 	inLines := make(chan *tailer.LogLine)
 	fs := afero.NewMemMapFs()
-	o := LoaderOptions{store, inLines, w, fs, nil, false, false, false, false, false, true, false}
+	o := LoaderOptions{store, inLines, w, fs, nil, false, false, false, false, false, true, false, false}
 	l, err := NewLoader(o)
 	if err != nil {
 		t.Fatalf("couldn't create loader: %s", err)
@@ -45,7 +47,7 @@ func TestCompileAndRun(t *testing.T) {
 	lines := make(chan *tailer.LogLine)
 	w := watcher.NewFakeWatcher()
 	fs := afero.NewMemMapFs()
-	o := LoaderOptions{store, lines, w, fs, nil, false, false, false, false, false, true, false}
+	o := LoaderOptions{store, lines, w, fs, nil, false, false, false, false, false, true, false, false}
 	l, err := NewLoader(o)
 	if err != nil {
 		t.Fatalf("couldn't create loader: %s", err)
@@ -121,7 +123,7 @@ func TestProcessEvents(t *testing.T) {
 			store := metrics.NewStore()
 			lines := make(chan *tailer.LogLine)
 			fs := afero.NewMemMapFs()
-			o := LoaderOptions{store, lines, w, fs, nil, false, false, false, false, false, true, false}
+			o := LoaderOptions{store, lines, w, fs, nil, false, false, false, false, false, true, false, false}
 			l, err := NewLoader(o)
 			if err != nil {
 				t.Fatalf("couldn't create loader: %s", err)
@@ -189,7 +191,7 @@ func TestLoadProg(t *testing.T) {
 	store := metrics.NewStore()
 	inLines := make(chan *tailer.LogLine)
 	fs := afero.NewMemMapFs()
-	o := LoaderOptions{store, inLines, w, fs, nil, false, false, false, false, false, true, false}
+	o := LoaderOptions{store, inLines, w, fs, nil, false, false, false, false, false, true, false, false}
 	l, err := NewLoader(o)
 	if err != nil {
 		t.Fatalf("couldn't create loader: %s", err)
@@ -203,3 +205,91 @@ func TestLoadProg(t *testing.T) {
 		}
 	}
 }
+
+func TestProgHealth(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *tailer.LogLine)
+	w := watcher.NewFakeWatcher()
+	fs := afero.NewMemMapFs()
+	o := LoaderOptions{Store: store, Lines: lines, W: w, FS: fs, EmitProgHealth: true}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("health", strings.NewReader("/(.*)/ {\n  strptime($1, \"2006-01-02\")\n}\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	health := func(name string) int64 {
+		store.RLock()
+		defer store.RUnlock()
+		for _, m := range store.Metrics[name] {
+			if m.Program == "health" {
+				d, err := m.GetDatum()
+				if err != nil {
+					t.Fatalf("no datum for %s: %s", name, err)
+				}
+				return datum.GetInt(d)
+			}
+		}
+		t.Fatalf("no metric %s for program health: %v", name, store.Metrics)
+		return 0
+	}
+	if r := health("mtail_prog_loaded"); r != 1 {
+		t.Errorf("expected program loaded, received %d", r)
+	}
+
+	lines <- &tailer.LogLine{Filename: "test", Line: "not a date"}
+	for i := 0; health("mtail_prog_runtime_errors") != 1; i++ {
+		if i > 100 {
+			t.Fatalf("runtime error not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := l.CompileAndRun("health", strings.NewReader("/(/ {}\n")); err == nil {
+		t.Errorf("expected compile error")
+	}
+	if r := health("mtail_prog_loaded"); r != 0 {
+		t.Errorf("expected program not loaded after compile error, received %d", r)
+	}
+	if r := len(store.Metrics["mtail_prog_loaded"]); r != 1 {
+		t.Errorf("expected one mtail_prog_loaded metric, received %d", r)
+	}
+
+	// A program whose metrics can't be added to the store isn't loaded.
+	if err := l.CompileAndRun("health", strings.NewReader("counter requests\n/./ {\n  requests++\n}\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	if r := health("mtail_prog_loaded"); r != 1 {
+		t.Errorf("expected program loaded, received %d", r)
+	}
+	if err := l.CompileAndRun("health", strings.NewReader("gauge requests\n/./ {\n  requests = 1\n}\n")); err == nil {
+		t.Errorf("expected error adding a gauge with the name of a counter")
+	}
+	if r := health("mtail_prog_loaded"); r != 0 {
+		t.Errorf("expected program not loaded after store error, received %d", r)
+	}
+	close(lines)
+	<-l.VMsDone
+}
+
+func TestProgHealthCompileOnly(t *testing.T) {
+	store := metrics.NewStore()
+	o := LoaderOptions{Store: store, Lines: make(chan *tailer.LogLine), W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), EmitProgHealth: true, CompileOnly: true}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("health", strings.NewReader("/(.*)/ {}\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	for _, m := range store.Metrics["mtail_prog_loaded"] {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatalf("no datum: %s", err)
+		}
+		if r := datum.GetInt(d); r != 0 {
+			t.Errorf("expected program not loaded in compile only mode, received %d", r)
+		}
+	}
+}
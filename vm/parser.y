@@ -5,6 +5,8 @@
 package vm
 
 import (
+    "fmt"
+
     "github.com/google/mtail/metrics"
     "github.com/golang/glog"
 )
@@ -29,7 +31,8 @@ import (
 %type <n> declaration declarator definition decoration_statement regex_pattern match_expr
 %type <kind> type_spec
 %type <text> as_spec
-%type <texts> by_spec by_expr_list
+%type <texts> by_spec by_expr_list export_spec
+%type <intVal> every_spec
 %type <flag> hide_spec
 %type <op> rel_op shift_op bitwise_op logical_op add_op mul_op match_op
 // Tokens and types are defined here.
@@ -38,7 +41,7 @@ import (
 // Types
 %token COUNTER GAUGE TIMER
 // Reserved words
-%token AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE
+%token AS BY CONST HIDDEN DEF DEL NEXT OTHERWISE ELSE EVERY RESET PUBLIC EXPORT_TO
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -449,6 +452,26 @@ declarator
     $$ = $1
     $$.(*declNode).exportedName = $2
   }
+  | declarator every_spec
+  {
+    $$ = $1
+    $$.(*declNode).exportEvery = $2
+  }
+  | declarator RESET
+  {
+    $$ = $1
+    $$.(*declNode).resetAfterExport = true
+  }
+  | declarator PUBLIC
+  {
+    $$ = $1
+    $$.(*declNode).public = true
+  }
+  | declarator export_spec
+  {
+    $$ = $1
+    $$.(*declNode).exportTo = $2
+  }
   | ID
   {
     $$ = &declNode{pos: tokenpos(mtaillex), name: $1}
@@ -504,6 +527,13 @@ by_expr_list
   }
   ;
 
+export_spec
+  : EXPORT_TO by_expr_list
+  {
+    $$ = $2
+  }
+  ;
+
 as_spec
   : AS STRING
   {
@@ -511,6 +541,17 @@ as_spec
   }
   ;
 
+every_spec
+  : EVERY INTLITERAL
+  {
+    if $2 < 1 {
+      pos := tokenpos(mtaillex)
+      mtaillex.(*parser).ErrorP(fmt.Sprintf("Export interval multiplier must be at least 1, not %d", $2), &pos)
+    }
+    $$ = $2
+  }
+  ;
+
 definition
   : mark_pos DEF ID compound_statement
   {
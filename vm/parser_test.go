@@ -32,6 +32,18 @@ var parserTests = []struct {
 	{"declare multi-dimensioned counter",
 		"counter foo by bar, baz, quux\n"},
 
+	{"declare counter exported every 5th push",
+		"counter foo by bar every 5\n"},
+
+	{"declare gauge reset after export",
+		"gauge foo by bar reset_after_export\n"},
+
+	{"declare public counter",
+		"counter foo by bar public\n"},
+
+	{"declare counter exported to targets",
+		"counter foo by bar export_to graphite, prometheus\n"},
+
 	{"declare hidden counter",
 		"hidden counter foo\n"},
 
@@ -341,6 +353,10 @@ var parserInvalidPrograms = []parserInvalidProgram{
 	foo++[$1]++
 	}`,
 		[]string{"index of non-terminal:2:7: syntax error"}},
+	{"export every zero pushes",
+		"counter foo every 0\n",
+		[]string{"export every zero pushes:1:19: Export interval multiplier must be at least 1, not 0"}},
+
 	{"index of non-terminal",
 		`// {
 	0[$1]++
@@ -181,6 +181,18 @@ func (u *Unparser) VisitBefore(n astNode) Visitor {
 		if len(v.keys) > 0 {
 			u.emit(" by " + strings.Join(v.keys, ", "))
 		}
+		if v.exportEvery > 0 {
+			u.emit(" every " + strconv.FormatInt(v.exportEvery, 10))
+		}
+		if v.resetAfterExport {
+			u.emit(" reset_after_export")
+		}
+		if v.public {
+			u.emit(" public")
+		}
+		if len(v.exportTo) > 0 {
+			u.emit(" export_to " + strings.Join(v.exportTo, ", "))
+		}
 
 	case *unaryExprNode:
 		switch v.op {
@@ -55,6 +55,8 @@ type VM struct {
 
 	syslogUseCurrentYear bool           // Overwrite zero years with the current year in a strptime.
 	loc                  *time.Location // Override local timezone with provided, if not empty
+
+	runtimeErrors datum.Datum // Counts runtime errors, if not nil.
 }
 
 // Push a value onto the stack
@@ -72,6 +74,9 @@ func (t *thread) Pop() (value interface{}) {
 
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
+	if v.runtimeErrors != nil {
+		datum.IncIntBy(v.runtimeErrors, 1, time.Now())
+	}
 	glog.Infof(v.name+": Runtime error: "+format+"\n", args...)
 	glog.Infof("VM stack:\n%s", debug.Stack())
 	glog.Infof("Dumping vm state")